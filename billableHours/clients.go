@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+// client directory:
+// - a client is a company billed for time, with the details printed in the invoice's bill-to block
+// - Name is the company name as it appears in uploads, matched case-insensitively; ID is a stable
+//   identifier that keeps working if the client is renamed
+// - renaming a client keeps its former names as aliases, matched like its name, so the time entries and
+//   uploads under an old name stay the client's; its billing settings move to the new name
+// - invoices resolve the company they are asked for by client ID first, then by name; companies
+//   without a client record are still invoiced, under the name they were asked for
+// - PaymentTermsDays overrides the default payment terms; PONumber is quoted on every invoice
+// - Template names the invoice template the client's invoices are branded with (see templates.go)
+// - Locale is the order the client's timesheets write dates in, us or eu (see dates.go)
+
+// Client is a client directory entry
+type Client struct {
+	ID               string
+	Name             string
+	LegalName        string
+	Address          string
+	TaxID            string
+	Email            string
+	PaymentTermsDays int
+	PONumber         string
+	Template         string
+	Locale           string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// validate checks a client before it is stored
+func (c Client) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("client name is required")
+	}
+	if c.PaymentTermsDays < 0 {
+		return fmt.Errorf("payment terms must not be negative")
+	}
+	if c.Email != "" && !strings.Contains(c.Email, "@") {
+		return fmt.Errorf("invalid contact email %q", c.Email)
+	}
+	if c.Locale != LocaleUS && c.Locale != LocaleEU && c.Locale != "" {
+		return fmt.Errorf("locale must be %s or %s, got %q", LocaleUS, LocaleEU, c.Locale)
+	}
+	return nil
+}
+
+// DisplayName is the name printed on invoices: the legal name, or the client name when there is none
+func (c Client) DisplayName() string {
+	if c.LegalName != "" {
+		return c.LegalName
+	}
+	return c.Name
+}
+
+// AddressLines splits the billing address into its lines, dropping blank ones
+func (c Client) AddressLines() []string {
+	var lines []string
+	for _, line := range strings.Split(c.Address, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// clientColumns are the client columns, in the order scanClient reads them
+const clientColumns = `id, name, legal_name, address, tax_id, email, payment_terms_days, po_number, template, locale, created_at, updated_at`
+
+// scanClient reads a client row
+func scanClient(row interface{ Scan(...any) error }) (Client, error) {
+	var c Client
+	err := row.Scan(&c.ID, &c.Name, &c.LegalName, &c.Address, &c.TaxID, &c.Email, &c.PaymentTermsDays, &c.PONumber, &c.Template, &c.Locale, &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+// saveClient creates a client when it has no ID, or replaces the client with its ID
+func saveClient(c Client) (Client, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	c.LegalName = strings.TrimSpace(c.LegalName)
+	c.Address = strings.TrimSpace(c.Address)
+	c.TaxID = strings.TrimSpace(c.TaxID)
+	c.Email = strings.TrimSpace(c.Email)
+	c.PONumber = strings.TrimSpace(c.PONumber)
+	c.Template = strings.TrimSpace(c.Template)
+	locale, err := parseLocale(c.Locale)
+	if err != nil {
+		return Client{}, err
+	}
+	c.Locale = locale
+	if err := c.validate(); err != nil {
+		return Client{}, err
+	}
+	if c.Template != "" {
+		if _, err := getTemplate(c.Template); err != nil {
+			return Client{}, err
+		}
+	}
+
+	// names and former names must stay unique, as they are how uploaded companies are matched to clients
+	var other string
+	err = DB.QueryRow(`
+		SELECT id FROM clients WHERE lower(name) = ? AND id != ?
+		UNION ALL
+		SELECT client_id FROM client_aliases WHERE name = ? AND client_id != ?
+		LIMIT 1
+	`, strings.ToLower(c.Name), c.ID, strings.ToLower(c.Name), c.ID).Scan(&other)
+	if err == nil {
+		return Client{}, fmt.Errorf("client %s already exists with id %s", c.Name, other)
+	}
+	if err != sql.ErrNoRows {
+		return Client{}, fmt.Errorf("failed to check client name: %w", err)
+	}
+
+	now := time.Now()
+	c.UpdatedAt = now
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+		c.CreatedAt = now
+		_, err = DB.Exec(`
+			INSERT INTO clients (`+clientColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, c.ID, c.Name, c.LegalName, c.Address, c.TaxID, c.Email, c.PaymentTermsDays, c.PONumber, c.Template, c.Locale, c.CreatedAt, c.UpdatedAt)
+		if err != nil {
+			return Client{}, fmt.Errorf("failed to save client: %w", err)
+		}
+		return c, nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow(`SELECT name FROM clients WHERE id = ?`, c.ID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return Client{}, fmt.Errorf("client %s not found", c.ID)
+	}
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to load client: %w", err)
+	}
+
+	err = tx.QueryRow(`
+		UPDATE clients
+		SET name = ?, legal_name = ?, address = ?, tax_id = ?, email = ?, payment_terms_days = ?, po_number = ?, template = ?, locale = ?, updated_at = ?
+		WHERE id = ?
+		RETURNING created_at
+	`, c.Name, c.LegalName, c.Address, c.TaxID, c.Email, c.PaymentTermsDays, c.PONumber, c.Template, c.Locale, c.UpdatedAt, c.ID).Scan(&c.CreatedAt)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to save client: %w", err)
+	}
+	if !strings.EqualFold(previous, c.Name) {
+		if err := renameClient(tx, c.ID, previous, c.Name); err != nil {
+			return Client{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Client{}, fmt.Errorf("failed to save client: %w", err)
+	}
+	return c, nil
+}
+
+// renameClient keeps a renamed client's former name as an alias and moves its billing settings
+// to the new name, unless the new name already has some
+func renameClient(tx *sql.Tx, id, from, to string) error {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+
+	// a client renamed back to a former name no longer needs it as an alias
+	if _, err := tx.Exec(`DELETE FROM client_aliases WHERE name = ?`, to); err != nil {
+		return fmt.Errorf("failed to update client aliases: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO client_aliases (name, client_id) VALUES (?, ?)`, from, id); err != nil {
+		return fmt.Errorf("failed to update client aliases: %w", err)
+	}
+
+	_, err := tx.Exec(`
+		UPDATE company_billing SET company = ?
+		WHERE company = ? AND NOT EXISTS (SELECT 1 FROM company_billing WHERE company = ?)
+	`, to, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to move billing settings: %w", err)
+	}
+	return nil
+}
+
+// clientAliases returns the former names of a client, lower-cased
+func clientAliases(id string) ([]string, error) {
+	rows, err := DB.Query(`SELECT name FROM client_aliases WHERE client_id = ? ORDER BY name`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client aliases: %w", err)
+	}
+	defer rows.Close()
+
+	var aliases []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read client alias: %w", err)
+		}
+		aliases = append(aliases, name)
+	}
+	return aliases, rows.Err()
+}
+
+// currentName returns the current name, lower-cased, of the client a company name is a former
+// name of, or the name itself when it is not one
+func currentName(company string) (string, error) {
+	var name string
+	err := DB.QueryRow(`
+		SELECT lower(c.name) FROM client_aliases a JOIN clients c ON c.id = a.client_id WHERE a.name = ?
+	`, strings.ToLower(company)).Scan(&name)
+	if err == sql.ErrNoRows {
+		return company, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load client aliases: %w", err)
+	}
+	return name, nil
+}
+
+// findClient looks a client up by ID, then by case-insensitive name or former name,
+// reporting whether one was found
+func findClient(ref string) (Client, bool, error) {
+	ref = strings.TrimSpace(ref)
+	c, err := scanClient(DB.QueryRow(`
+		SELECT `+clientColumns+`
+		FROM clients
+		WHERE id = ? OR lower(name) = ? OR id IN (SELECT client_id FROM client_aliases WHERE name = ?)
+		ORDER BY id = ? DESC, lower(name) = ? DESC
+		LIMIT 1
+	`, ref, strings.ToLower(ref), strings.ToLower(ref), ref, strings.ToLower(ref)))
+	if err == sql.ErrNoRows {
+		return Client{}, false, nil
+	}
+	if err != nil {
+		return Client{}, false, fmt.Errorf("failed to load client: %w", err)
+	}
+	return c, true, nil
+}
+
+// getClient looks up a client by ID or name
+func getClient(ref string) (Client, error) {
+	c, found, err := findClient(ref)
+	if err != nil {
+		return Client{}, err
+	}
+	if !found {
+		return Client{}, fmt.Errorf("client %s not found", ref)
+	}
+	return c, nil
+}
+
+// listClients returns the client directory by name
+func listClients() ([]Client, error) {
+	rows, err := DB.Query(`SELECT ` + clientColumns + ` FROM clients ORDER BY lower(name)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []Client{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client: %w", err)
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// clientLocales returns the locale of every client that has one, by lower-case client name and former name
+func clientLocales() (map[string]string, error) {
+	rows, err := DB.Query(`
+		SELECT lower(name), locale FROM clients WHERE locale != ''
+		UNION ALL
+		SELECT a.name, c.locale FROM client_aliases a JOIN clients c ON c.id = a.client_id WHERE c.locale != ''
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client locales: %w", err)
+	}
+	defer rows.Close()
+
+	locales := make(map[string]string)
+	for rows.Next() {
+		var name, locale string
+		if err := rows.Scan(&name, &locale); err != nil {
+			return nil, fmt.Errorf("failed to read client locale: %w", err)
+		}
+		locales[name] = locale
+	}
+	return locales, rows.Err()
+}
+
+// deleteClient removes a client and its former names; its time entries and issued invoices are kept
+func deleteClient(id string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM clients WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("client %s not found", id)
+	}
+	if _, err := tx.Exec(`DELETE FROM client_aliases WHERE client_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete client aliases: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+	return nil
+}
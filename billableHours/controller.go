@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // upload handles file uploads via multipart/form-data
@@ -17,6 +25,232 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		RespondWithError(w, 400, "failed to parse file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	opts, err := uploadOptions(r)
+	if err != nil {
+		RespondWithError(w, 400, "invalid upload options", err.Error())
+		return
+	}
+
+	// process the csv file or excel workbook from upload
+	read := readCSV
+	if isSpreadsheet(header.Filename) {
+		read = readXLSX
+	}
+	res, err := read(file, header.Filename, opts)
+	if err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			RespondWithErrorDetails(w, 422, "file failed validation", err.Error(), verr.Errors)
+			return
+		}
+		RespondWithError(w, 400, "failed to read file", err.Error())
+		return
+	}
+
+	message := "file uploaded successfully"
+	if opts.Mode == ModeValidate {
+		message = "file validated successfully"
+	}
+	err = RespondWithJSON(w, 200, message, res)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// uploadOptions reads the optional form fields controlling how an upload is read:
+// "profile" names a stored import profile and "mapping" is a JSON column mapping,
+// whose entries override the profile's; "mode" is strict, lenient, validate or merge,
+// which checks rows like strict but skips the entries already uploaded or repeated in the
+// file, reporting them as duplicates; "sheet" picks the sheet of an Excel workbook by name
+// or 1-based index; "delimiter", "encoding" and "quoting" override the detected dialect of
+// a CSV file; "locale" sets the order of day and month in dates
+func uploadOptions(r *http.Request) (UploadOptions, error) {
+	opts := UploadOptions{Mapping: ColumnMapping{}, Mode: r.FormValue("mode"), Sheet: r.FormValue("sheet")}
+
+	locale, err := parseLocale(r.FormValue("locale"))
+	if err != nil {
+		return UploadOptions{}, err
+	}
+	opts.Locale = locale
+
+	dialect, err := parseDialect(r.FormValue("delimiter"), r.FormValue("encoding"), r.FormValue("quoting"))
+	if err != nil {
+		return UploadOptions{}, err
+	}
+	opts.Dialect = dialect
+
+	if name := r.FormValue("profile"); name != "" {
+		p, err := getProfile(name)
+		if err != nil {
+			return UploadOptions{}, err
+		}
+		for col, header := range p.Mapping {
+			opts.Mapping[col] = header
+		}
+	}
+
+	if raw := r.FormValue("mapping"); raw != "" {
+		var mapping ColumnMapping
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			return UploadOptions{}, fmt.Errorf("mapping must be a JSON object of column to header name: %w", err)
+		}
+		for col, header := range mapping {
+			opts.Mapping[col] = header
+		}
+	}
+
+	return opts, nil
+}
+
+// profiles lists all import profiles
+func profiles(w http.ResponseWriter, r *http.Request) {
+	ps, err := listProfiles()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list import profiles", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "import profiles retrieved successfully", ps)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// profile returns a single import profile
+func profile(w http.ResponseWriter, r *http.Request) {
+	p, err := getProfile(mux.Vars(r)["name"])
+	if err != nil {
+		RespondWithError(w, 404, "import profile not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "import profile retrieved successfully", p)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// upsertProfile creates or replaces an import profile from a JSON body
+func upsertProfile(w http.ResponseWriter, r *http.Request) {
+	var p ImportProfile
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&p); err != nil {
+		RespondWithError(w, 400, "invalid import profile", err.Error())
+		return
+	}
+	if name, ok := mux.Vars(r)["name"]; ok {
+		p.Name = name
+	}
+
+	p, err := saveProfile(p)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save import profile", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "import profile saved successfully", p)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// removeProfile removes an import profile
+func removeProfile(w http.ResponseWriter, r *http.Request) {
+	if err := deleteProfile(mux.Vars(r)["name"]); err != nil {
+		RespondWithError(w, 404, "import profile not found", err.Error())
+		return
+	}
+
+	err := RespondWithJSON(w, 200, "import profile deleted successfully", nil)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// billingSettings returns a company's billing settings (taxes and discount)
+func billingSettings(w http.ResponseWriter, r *http.Request) {
+	b, err := getBillingSettings(mux.Vars(r)["companyName"])
+	if err != nil {
+		RespondWithError(w, 500, "failed to load billing settings", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "billing settings retrieved successfully", b)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// updateBillingSettings replaces a company's billing settings from a JSON body
+func updateBillingSettings(w http.ResponseWriter, r *http.Request) {
+	var b BillingSettings
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&b); err != nil {
+		RespondWithError(w, 400, "invalid billing settings", err.Error())
+		return
+	}
+	b.Company = mux.Vars(r)["companyName"]
+
+	b, err := saveBillingSettings(b)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save billing settings", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "billing settings saved successfully", b)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// exchangeRates lists the exchange rate table
+func exchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := listExchangeRates()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list exchange rates", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "exchange rates retrieved successfully", rates)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// updateExchangeRates creates or replaces exchange rates from a JSON list
+func updateExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var rates []ExchangeRate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&rates); err != nil {
+		RespondWithError(w, 400, "invalid exchange rates", err.Error())
+		return
+	}
+
+	rates, err := saveExchangeRates(rates)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save exchange rates", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "exchange rates saved successfully", rates)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// uploadExchangeRates creates or replaces exchange rates from an uploaded CSV file
+func uploadExchangeRates(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20) // 10 MB
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		RespondWithError(w, 400, "failed to parse multipart form", err.Error())
+		return
+	}
+
 	file, _, err := r.FormFile("file")
 	if err != nil {
 		RespondWithError(w, 400, "failed to parse file", err.Error())
@@ -24,38 +258,532 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	//fmt.Printf("uploaded File: %+v\n", header)
+	rates, err := readExchangeRates(file)
+	if err != nil {
+		RespondWithError(w, 400, "failed to read file", err.Error())
+		return
+	}
+
+	rates, err = saveExchangeRates(rates)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save exchange rates", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "exchange rates uploaded successfully", rates)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// employees lists the employee directory
+func employees(w http.ResponseWriter, r *http.Request) {
+	staff, err := listStaff()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list employees", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employees retrieved successfully", staff)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// employee returns a single employee directory entry
+func employee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		RespondWithError(w, 400, "invalid employee id", err.Error())
+		return
+	}
+
+	s, err := getStaffMember(id)
+	if err != nil {
+		RespondWithError(w, 404, "employee not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employee retrieved successfully", s)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// upsertEmployee creates or replaces an employee directory entry from a JSON body
+func upsertEmployee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		RespondWithError(w, 400, "invalid employee id", err.Error())
+		return
+	}
+
+	var s StaffMember
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&s); err != nil {
+		RespondWithError(w, 400, "invalid employee", err.Error())
+		return
+	}
+	s.ID = id
+
+	staff, err := saveStaff([]StaffMember{s})
+	if err != nil {
+		RespondWithError(w, 400, "failed to save employee", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employee saved successfully", staff[0])
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// updateEmployees creates or replaces employee directory entries from a JSON list
+func updateEmployees(w http.ResponseWriter, r *http.Request) {
+	var staff []StaffMember
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&staff); err != nil {
+		RespondWithError(w, 400, "invalid employees", err.Error())
+		return
+	}
+
+	staff, err := saveStaff(staff)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save employees", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employees saved successfully", staff)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// uploadEmployees creates or replaces employee directory entries from an uploaded CSV file
+func uploadEmployees(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20) // 10 MB
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		RespondWithError(w, 400, "failed to parse multipart form", err.Error())
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		RespondWithError(w, 400, "failed to parse file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	staff, err := readStaff(file)
+	if err != nil {
+		RespondWithError(w, 400, "failed to read file", err.Error())
+		return
+	}
+
+	staff, err = saveStaff(staff)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save employees", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employees uploaded successfully", staff)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// removeEmployee removes an employee directory entry
+func removeEmployee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		RespondWithError(w, 400, "invalid employee id", err.Error())
+		return
+	}
+
+	if err := deleteStaffMember(id); err != nil {
+		RespondWithError(w, 404, "employee not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "employee deleted successfully", nil)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// clients lists the client directory
+func clients(w http.ResponseWriter, r *http.Request) {
+	cs, err := listClients()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list clients", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "clients retrieved successfully", cs)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// client returns a single client, looked up by ID or name
+func client(w http.ResponseWriter, r *http.Request) {
+	c, err := getClient(mux.Vars(r)["id"])
+	if err != nil {
+		RespondWithError(w, 404, "client not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "client retrieved successfully", c)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// upsertClient creates a client from a JSON body, or replaces the client with the ID in the path
+func upsertClient(w http.ResponseWriter, r *http.Request) {
+	var c Client
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&c); err != nil {
+		RespondWithError(w, 400, "invalid client", err.Error())
+		return
+	}
+	c.ID = mux.Vars(r)["id"]
+
+	c, err := saveClient(c)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save client", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "client saved successfully", c)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// removeClient removes a client
+func removeClient(w http.ResponseWriter, r *http.Request) {
+	if err := deleteClient(mux.Vars(r)["id"]); err != nil {
+		RespondWithError(w, 404, "client not found", err.Error())
+		return
+	}
+
+	err := RespondWithJSON(w, 200, "client deleted successfully", nil)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// invoiceTemplates lists the invoice templates
+func invoiceTemplates(w http.ResponseWriter, r *http.Request) {
+	ts, err := listTemplates()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list invoice templates", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoice templates retrieved successfully", ts)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
 
-	// process csv from upload
-	cm, err := readCSV(file)
+// invoiceTemplate returns a single invoice template
+func invoiceTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := getTemplate(mux.Vars(r)["name"])
+	if err != nil {
+		RespondWithError(w, 404, "invoice template not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoice template retrieved successfully", t)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// upsertTemplate creates or replaces an invoice template from a JSON body
+func upsertTemplate(w http.ResponseWriter, r *http.Request) {
+	var t InvoiceTemplate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&t); err != nil {
+		RespondWithError(w, 400, "invalid invoice template", err.Error())
+		return
+	}
+	t.Name = mux.Vars(r)["name"]
+
+	t, err := saveTemplate(t)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save invoice template", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoice template saved successfully", t)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// uploadTemplateLogo replaces an invoice template's logo with an uploaded PNG or JPEG file
+func uploadTemplateLogo(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20) // 10 MB
+
+	t, err := getTemplate(mux.Vars(r)["name"])
+	if err != nil {
+		RespondWithError(w, 404, "invoice template not found", err.Error())
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		RespondWithError(w, 400, "failed to parse multipart form", err.Error())
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		RespondWithError(w, 400, "failed to parse file", err.Error())
+		return
+	}
+	defer file.Close()
+
+	t.Logo, err = io.ReadAll(file)
 	if err != nil {
 		RespondWithError(w, 400, "failed to read file", err.Error())
 		return
 	}
 
-	err = RespondWithJSON(w, 200, "file uploaded successfully", cm)
+	t, err = saveTemplate(t)
+	if err != nil {
+		RespondWithError(w, 400, "failed to save invoice template", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoice template logo uploaded successfully", t)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// removeTemplate removes an invoice template that no client uses
+func removeTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, err := getTemplate(name); err != nil {
+		RespondWithError(w, 404, "invoice template not found", err.Error())
+		return
+	}
+	if err := deleteTemplate(name); err != nil {
+		RespondWithError(w, 409, "failed to delete invoice template", err.Error())
+		return
+	}
+
+	err := RespondWithJSON(w, 200, "invoice template deleted successfully", nil)
 	if err != nil {
 		log.Printf("failed to write response: %v", err)
 	}
 }
 
-// download generates and serves an invoice PDF for the specified company
+// batches lists all upload batches
+func batches(w http.ResponseWriter, r *http.Request) {
+	bs, err := listBatches()
+	if err != nil {
+		RespondWithError(w, 500, "failed to list batches", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "batches retrieved successfully", bs)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// batch returns a single upload batch
+func batch(w http.ResponseWriter, r *http.Request) {
+	b, err := getBatch(mux.Vars(r)["id"])
+	if err != nil {
+		RespondWithError(w, 404, "batch not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "batch retrieved successfully", b)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// invoices lists the invoice register, optionally filtered by ?company=
+func invoices(w http.ResponseWriter, r *http.Request) {
+	invs, err := listInvoices(r.URL.Query().Get("company"))
+	if err != nil {
+		RespondWithError(w, 500, "failed to list invoices", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoices retrieved successfully", invs)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// invoice returns a single invoice from the register
+func invoice(w http.ResponseWriter, r *http.Request) {
+	inv, err := getInvoice(mux.Vars(r)["number"])
+	if err != nil {
+		RespondWithError(w, 404, "invoice not found", err.Error())
+		return
+	}
+
+	err = RespondWithJSON(w, 200, "invoice retrieved successfully", inv)
+	if err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// download generates and serves an invoice for the specified company, named or
+// given by client ID, as a PDF
+// unless another format is asked for through the format parameter or the Accept header.
+// When the route carries a batch id, only that batch's entries are invoiced.
 func download(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	companyName := vars["companyName"]
+	companyName := mux.Vars(r)["companyName"]
 	if companyName == "" {
 		RespondWithError(w, 400, "invalid companyName", "Please provide a valid company name")
 		return
 	}
 
-	filename, err := generateInvoice(companyName)
+	filter, opts, ok := invoiceParams(w, r)
+	if !ok {
+		return
+	}
+
+	// an explicit format parameter wins over the Accept header
+	if opts.Format == "" {
+		name, ok := negotiateFormat(r.Header.Get("Accept"))
+		if !ok {
+			RespondWithError(w, 406, "unsupported invoice format", "Accept must include application/pdf, text/html, text/csv, application/json or application/xml")
+			return
+		}
+		opts.Format = name
+	}
+
+	out, err := generateInvoice(companyName, filter, opts)
 	if err != nil {
 		RespondWithError(w, 400, "failed to generate invoice", err.Error())
 		return
 	}
 
-	// serve file as download
-	w.Header().Set("Content-Type", "application/pdf")
+	// stream the rendered invoice as a download
+	if out.Number != "" {
+		w.Header().Set("X-Invoice-Number", out.Number)
+	}
+	w.Header().Set("Content-Type", renderers[opts.Format].ContentType())
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Disposition", "attachment; filename="+out.Filename)
+	http.ServeContent(w, r, out.Filename, out.CreatedAt, bytes.NewReader(out.Content))
+}
+
+// exportInvoices generates invoices for several companies and streams them as a ZIP
+// archive with a manifest. Companies are chosen with ?company= (repeated or comma
+// separated); without any, every company with entries in the period is invoiced.
+func exportInvoices(w http.ResponseWriter, r *http.Request) {
+	filter, opts, ok := invoiceParams(w, r)
+	if !ok {
+		return
+	}
+
+	var companies []string
+	for _, value := range r.URL.Query()["company"] {
+		companies = append(companies, strings.Split(value, ",")...)
+	}
+
+	docs, err := buildExport(companies, filter, opts)
+	if err != nil {
+		RespondWithError(w, 400, "failed to generate invoices", err.Error())
+		return
+	}
+
+	rendered, err := renderInvoices(docs, opts.Format)
+	if err != nil {
+		RespondWithError(w, 500, "failed to generate invoices", err.Error())
+		return
+	}
+
+	// stream the archive; once it has started, errors can only be logged
+	filename := "invoices_" + time.Now().Format(dateLayout) + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	http.ServeFile(w, r, filename)
+	if err := writeExport(w, rendered); err != nil {
+		log.Printf("failed to write export: %v", err)
+	}
+}
+
+// invoiceParams reads the invoice query parameters shared by download and exportInvoices:
+// the optional batch id from the route, billing period, mode, draft flag, ordering and format.
+// On failure it responds with an error and returns false.
+func invoiceParams(w http.ResponseWriter, r *http.Request) (EntryFilter, InvoiceOptions, bool) {
+	var filter EntryFilter
+	if id, ok := mux.Vars(r)["id"]; ok {
+		if _, err := getBatch(id); err != nil {
+			RespondWithError(w, 404, "batch not found", err.Error())
+			return filter, InvoiceOptions{}, false
+		}
+		filter.BatchID = id
+	}
+
+	// optional billing period
+	from, err := dateParam(r, "from")
+	if err != nil {
+		RespondWithError(w, 400, "invalid from date", err.Error())
+		return filter, InvoiceOptions{}, false
+	}
+	to, err := dateParam(r, "to")
+	if err != nil {
+		RespondWithError(w, 400, "invalid to date", err.Error())
+		return filter, InvoiceOptions{}, false
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		RespondWithError(w, 400, "invalid billing period", "from date must not be after to date")
+		return filter, InvoiceOptions{}, false
+	}
+	filter.From, filter.To = from, to
+
+	var opts InvoiceOptions
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "summary":
+	case "itemised", "itemized":
+		opts.Itemised = true
+	default:
+		RespondWithError(w, 400, "invalid mode", "mode must be summary or itemised, got "+mode)
+		return filter, opts, false
+	}
+
+	opts.Draft = r.URL.Query().Get("draft") == "true"
+
+	// employee order and grouping
+	opts.SortBy = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("sort")))
+	opts.Order = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("order")))
+	opts.GroupBy = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("group")))
+	if err := opts.validateOrdering(); err != nil {
+		RespondWithError(w, 400, "invalid invoice order", err.Error())
+		return filter, opts, false
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		name, ok := formatName(format)
+		if !ok {
+			RespondWithError(w, 400, "invalid format", "format must be pdf, html, csv, json or ubl, got "+format)
+			return filter, opts, false
+		}
+		opts.Format = name
+	}
+	return filter, opts, true
+}
+
+// dateParam parses an optional YYYY-MM-DD query parameter, returning the zero time when absent
+func dateParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	d, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be formatted as YYYY-MM-DD, got %q", name, value)
+	}
+	return d, nil
 }
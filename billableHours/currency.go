@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// currencies:
+// - every company is billed in one currency (billing settings, or defaultCurrency)
+// - a time entry's rate may be in another currency (optional Currency column)
+// - amounts are converted into the invoice currency with the locally managed exchange rate table
+// - a rate stored as base -> quote is also used, inverted, for quote -> base
+
+// defaultCurrency is used for companies without a currency, overridable through the environment in main
+var defaultCurrency = "USD"
+
+// currencySymbols are printed before amounts; other currencies are printed with their code.
+// Symbols must be representable in the core PDF fonts (cp1252), hence GH¢ for the cedi.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"GHS": "GH¢",
+	"JPY": "¥",
+}
+
+// ExchangeRate converts between two currencies: 1 Base = Rate Quote
+type ExchangeRate struct {
+	Base      string
+	Quote     string
+	Rate      float64
+	UpdatedAt time.Time
+}
+
+// isCurrencyCode reports whether code looks like an ISO 4217 currency code
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeCurrency uppercases and trims a currency code
+func normalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// formatMoney formats an amount with its currency symbol, or its code when it has none
+func formatMoney(amount float64, currency string) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		if amount < 0 {
+			return fmt.Sprintf("-%s%.2f", symbol, -amount)
+		}
+		return fmt.Sprintf("%s%.2f", symbol, amount)
+	}
+	return fmt.Sprintf("%s %.2f", currency, amount)
+}
+
+// currencyLabel describes a currency for invoice headers, e.g. "EUR (€)"
+func currencyLabel(currency string) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%s (%s)", currency, symbol)
+	}
+	return currency
+}
+
+// validate checks an exchange rate before it is stored
+func (x ExchangeRate) validate() error {
+	if !isCurrencyCode(x.Base) || !isCurrencyCode(x.Quote) {
+		return fmt.Errorf("invalid currency pair %s/%s, expected 3-letter currency codes", x.Base, x.Quote)
+	}
+	if x.Base == x.Quote {
+		return fmt.Errorf("invalid currency pair %s/%s, currencies must differ", x.Base, x.Quote)
+	}
+	if x.Rate <= 0 {
+		return fmt.Errorf("rate for %s/%s must be positive", x.Base, x.Quote)
+	}
+	return nil
+}
+
+// saveExchangeRates creates or replaces exchange rates in a single transaction
+func saveExchangeRates(rates []ExchangeRate) ([]ExchangeRate, error) {
+	now := time.Now()
+	for i := range rates {
+		rates[i].Base = normalizeCurrency(rates[i].Base)
+		rates[i].Quote = normalizeCurrency(rates[i].Quote)
+		rates[i].UpdatedAt = now
+		if err := rates[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, x := range rates {
+		_, err := tx.Exec(`
+			INSERT INTO exchange_rates (base, quote, rate, updated_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (base, quote) DO UPDATE SET rate = excluded.rate, updated_at = excluded.updated_at
+		`, x.Base, x.Quote, x.Rate, x.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save exchange rate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit exchange rates: %w", err)
+	}
+	return rates, nil
+}
+
+// listExchangeRates returns the exchange rate table
+func listExchangeRates() ([]ExchangeRate, error) {
+	rows, err := DB.Query(`
+		SELECT base, quote, rate, updated_at
+		FROM exchange_rates
+		ORDER BY base, quote
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var x ExchangeRate
+		if err := rows.Scan(&x.Base, &x.Quote, &x.Rate, &x.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read exchange rate: %w", err)
+		}
+		rates = append(rates, x)
+	}
+	return rates, rows.Err()
+}
+
+// readExchangeRates reads an exchange rate table from CSV with Base, Quote and Rate columns,
+// in any dialect openCSV detects
+func readExchangeRates(reader io.Reader) ([]ExchangeRate, error) {
+	src, err := openCSV(reader, CSVDialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	// skip header
+	if _, _, err := src.Read(); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	var rates []ExchangeRate
+	for {
+		record, line, err := src.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: invalid record: expected >=3 fields, got %d", line, len(record))
+		}
+
+		rate, err := src.dialect.parseNumber(record[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[2])
+		}
+		rates = append(rates, ExchangeRate{Base: record[0], Quote: record[1], Rate: rate})
+	}
+	return rates, nil
+}
+
+// currencyConverter converts amounts into a single target currency
+type currencyConverter struct {
+	target string
+	rates  map[[2]string]float64
+}
+
+// newConverter loads the exchange rate table for converting into the target currency
+func newConverter(target string) (currencyConverter, error) {
+	rates, err := listExchangeRates()
+	if err != nil {
+		return currencyConverter{}, err
+	}
+
+	c := currencyConverter{target: target, rates: make(map[[2]string]float64, len(rates))}
+	for _, x := range rates {
+		c.rates[[2]string{x.Base, x.Quote}] = x.Rate
+	}
+	return c, nil
+}
+
+// rate returns how many target units one unit of the currency is worth.
+// An empty currency is the target currency.
+func (c currencyConverter) rate(currency string) (float64, error) {
+	if currency == "" || currency == c.target {
+		return 1, nil
+	}
+	if r, ok := c.rates[[2]string{currency, c.target}]; ok {
+		return r, nil
+	}
+	if r, ok := c.rates[[2]string{c.target, currency}]; ok {
+		return 1 / r, nil
+	}
+	return 0, fmt.Errorf("no exchange rate from %s to %s", currency, c.target)
+}
+
+// convertEmployees converts every invoice line's cost into the target currency.
+// Lines keep their original rate and currency for display.
+func (c currencyConverter) convertEmployees(employees EmployeeMap) (EmployeeMap, error) {
+	converted := make(EmployeeMap, len(employees))
+	for id, emp := range employees {
+		out := Employee{TotalHours: emp.TotalHours, RawHours: emp.RawHours, Rates: make([]RateLine, len(emp.Rates))}
+		for i, line := range emp.Rates {
+			if line.Currency == "" {
+				line.Currency = c.target
+			}
+			r, err := c.rate(line.Currency)
+			if err != nil {
+				return nil, fmt.Errorf("employee %d: %w", id, err)
+			}
+			line.Cost *= r
+			out.TotalCost += line.Cost
+			out.Rates[i] = line
+		}
+		converted[id] = out
+	}
+	return converted, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dates and times in uploads:
+// - work dates are ISO (2019-07-01), year first (2019/07/01), or day, month and year separated by
+//   "/", "." or "-" in the order of a locale: month first in the US (7/1/19), day first in Europe (1.7.2019)
+// - a date with a day over 12 only reads one way; the others are read in the upload's locale, else the
+//   locale of the row's client (see clients.go), else the order the file's unambiguous dates use
+// - with a locale, dates must be written in its order; without one, dates that could still be read
+//   either way are read month first, as they always were, and reported with the upload
+// - clock times are 24-hour (17:00, 17:00:00) or 12-hour (5:00 PM, 5:30pm, 5 PM); full datetimes are
+//   an ISO date followed by a clock time
+
+// locales
+const (
+	// LocaleUS writes dates month first
+	LocaleUS = "us"
+	// LocaleEU writes dates day first
+	LocaleEU = "eu"
+)
+
+// parseLocale reads a locale: us, eu, or a language tag whose region picks the date order
+// (en-US month first, en-GB or de-DE day first). Empty means no locale.
+func parseLocale(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "", LocaleUS, LocaleEU:
+		return value, nil
+	}
+
+	lang, region, ok := strings.Cut(strings.ReplaceAll(value, "_", "-"), "-")
+	if !ok || len(lang) < 2 || len(lang) > 3 || len(region) != 2 {
+		return "", fmt.Errorf("locale must be %s (month first), %s (day first) or a tag such as en-US or de-DE, got %q", LocaleUS, LocaleEU, value)
+	}
+	if region == "us" {
+		return LocaleUS, nil
+	}
+	return LocaleEU, nil
+}
+
+// numericDatePattern matches a date written as day and month numbers in either order, then the year
+var numericDatePattern = regexp.MustCompile(`^(\d{1,2})([/.-])(\d{1,2})([/.-])(\d{2}|\d{4})$`)
+
+// yearFirstPattern matches a date written year first, as ISO dates are
+var yearFirstPattern = regexp.MustCompile(`^(\d{4})([/.-])(\d{1,2})([/.-])(\d{1,2})$`)
+
+// numericDate is a date written as numbers: First and Second are the day and month,
+// in an order that may depend on the locale
+type numericDate struct {
+	First, Second, Year int
+	// YearFirst is set for dates written year, month, day, whose order is never in doubt
+	YearFirst bool
+}
+
+// splitDate reads the numbers of a date, reporting false for anything else
+func splitDate(value string) (numericDate, bool) {
+	value = strings.TrimSpace(value)
+	if m := yearFirstPattern.FindStringSubmatch(value); m != nil && m[2] == m[4] {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[3])
+		day, _ := strconv.Atoi(m[5])
+		return numericDate{First: month, Second: day, Year: year, YearFirst: true}, true
+	}
+
+	m := numericDatePattern.FindStringSubmatch(value)
+	if m == nil || m[2] != m[4] {
+		return numericDate{}, false
+	}
+	first, _ := strconv.Atoi(m[1])
+	second, _ := strconv.Atoi(m[3])
+	year, _ := strconv.Atoi(m[5])
+	// two-digit years are read like time.Parse reads them
+	if len(m[5]) == 2 {
+		year += 2000
+		if year >= 2069 {
+			year -= 100
+		}
+	}
+	return numericDate{First: first, Second: second, Year: year}, true
+}
+
+// dayFirst reports whether the date must be read day first, and whether its order is known at all
+func (d numericDate) dayFirst() (dayFirst bool, known bool) {
+	switch {
+	case d.YearFirst || d.First == d.Second || d.Second > 12:
+		return false, true
+	case d.First > 12:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// date is the date read month first, or day first
+func (d numericDate) date(dayFirst bool) (time.Time, error) {
+	month, day := d.First, d.Second
+	if dayFirst {
+		month, day = day, month
+	}
+	if month < 1 || month > 12 {
+		return time.Time{}, fmt.Errorf("no month %d", month)
+	}
+	t := time.Date(d.Year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if day < 1 || t.Day() != day {
+		return time.Time{}, fmt.Errorf("no day %d in %s %d", day, time.Month(month), d.Year)
+	}
+	return t, nil
+}
+
+// dateReader reads the work dates of an upload, resolving the order of ambiguous dates
+// and collecting the dates it could only guess
+type dateReader struct {
+	// locale is the upload's locale, empty when it has none
+	locale string
+	// clients holds the locale of each client that has one, by lower-case name
+	clients map[string]string
+	// fileDayFirst and fileKnown are the order of the file's unambiguous dates, when they agree
+	fileDayFirst bool
+	fileKnown    bool
+	// Ambiguous lists the dates read month first for want of anything better
+	Ambiguous []RowError
+}
+
+// newDateReader prepares to read the dates of an upload, learning the file's date order from
+// the values in its date column
+func newDateReader(locale string, clients map[string]string, values []string) *dateReader {
+	r := &dateReader{locale: locale, clients: clients, Ambiguous: []RowError{}}
+	var dayFirst, monthFirst bool
+	for _, value := range values {
+		d, ok := splitDate(value)
+		if !ok || d.YearFirst || d.First == d.Second {
+			continue
+		}
+		if first, known := d.dayFirst(); known {
+			dayFirst = dayFirst || first
+			monthFirst = monthFirst || !first
+		}
+	}
+	r.fileDayFirst, r.fileKnown = dayFirst, dayFirst != monthFirst
+	return r
+}
+
+// parse reads the work date of a row for the company. When the date could be read either way
+// and nothing settles it, the other reading is returned as well.
+func (r *dateReader) parse(value, company string) (date, other time.Time, err error) {
+	value = strings.TrimSpace(value)
+	if d, err := time.Parse(dateLayout, value); err == nil {
+		return d, time.Time{}, nil
+	}
+	d, ok := splitDate(value)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("unrecognised date format")
+	}
+
+	locale := r.locale
+	if locale == "" {
+		locale = r.clients[company]
+	}
+	if locale != "" && !d.YearFirst {
+		date, err := d.date(locale == LocaleEU)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w for locale %s", err, locale)
+		}
+		return date, time.Time{}, nil
+	}
+
+	dayFirst, known := d.dayFirst()
+	if !known && r.fileKnown {
+		dayFirst, known = r.fileDayFirst, true
+	}
+	date, err = d.date(dayFirst)
+	if err != nil || known {
+		return date, time.Time{}, err
+	}
+	other, _ = d.date(true)
+	return date, other, nil
+}
+
+// clockLayouts are the clock time formats accepted, after normalizeClock
+var clockLayouts = []string{"15:04", "15:04:05", "3:04 PM", "3:04:05 PM", "3 PM"}
+
+// normalizeClock upper-cases a clock time and spaces out its AM or PM, so "5:30pm" reads as "5:30 PM"
+func normalizeClock(value string) string {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.NewReplacer("A.M.", "AM", "P.M.", "PM").Replace(value)
+	for _, suffix := range []string{"AM", "PM"} {
+		if rest, ok := strings.CutSuffix(value, suffix); ok {
+			return strings.TrimSpace(rest) + " " + suffix
+		}
+	}
+	return value
+}
+
+// parseClockTime reads a clock time as the time since midnight
+func parseClockTime(value string) (time.Duration, bool) {
+	value = normalizeClock(value)
+	for _, layout := range clockLayouts {
+		if c, err := time.Parse(layout, value); err == nil {
+			return time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute + time.Duration(c.Second())*time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses a clock time on the given date, or a full datetime
+func parseClock(date time.Time, value string) (time.Time, error) {
+	if d, ok := parseClockTime(value); ok {
+		return date.Add(d), nil
+	}
+
+	// full datetimes are an ISO date, then a clock time
+	value = strings.TrimSpace(value)
+	if len(value) > len(dateLayout) && (value[len(dateLayout)] == ' ' || value[len(dateLayout)] == 'T') {
+		if day, err := time.Parse(dateLayout, value[:len(dateLayout)]); err == nil {
+			if d, ok := parseClockTime(value[len(dateLayout)+1:]); ok {
+				return day.Add(d), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected HH:MM, H:MM AM/PM or YYYY-MM-DD HH:MM")
+}
+
+// isClock reports whether a time value is a bare clock time rather than a full datetime
+func isClock(value string) bool {
+	_, ok := parseClockTime(value)
+	return ok
+}
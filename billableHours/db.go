@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var DB *sql.DB
+
+// InitDB initializes the SQLite database and runs migrations
+func InitDB(path string) error {
+	var err error
+	DB, err = sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect database: %w", err)
+	}
+
+	// sqlite serialises writes anyway, and a single connection keeps
+	// in-memory databases (used by the tests) from splitting per connection
+	DB.SetMaxOpenConns(1)
+
+	// upload batches, raw time entries, import profiles, the invoice register,
+	// per-company billing settings, exchange rates, the employee and client
+	// directories with the clients' former names, invoice templates and the rolled-up
+	// company -> employee view of the hours worked. Invoices and upload summaries roll
+	// entries up in Go, after rounding, overtime and currency conversion
+	schema := `
+	CREATE TABLE IF NOT EXISTS batches (
+		id TEXT PRIMARY KEY,
+		filename TEXT NOT NULL,
+		entry_count INTEGER NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS time_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		batch_id TEXT NOT NULL REFERENCES batches (id),
+		employee_id INTEGER NOT NULL,
+		billable_rate REAL NOT NULL,
+		currency TEXT NOT NULL,
+		company TEXT NOT NULL,
+		work_date DATE NOT NULL,
+		start_time DATETIME NOT NULL,
+		end_time DATETIME NOT NULL,
+		hours REAL NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS import_profiles (
+		name TEXT PRIMARY KEY,
+		mapping TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS invoice_sequences (
+		prefix TEXT PRIMARY KEY,
+		last_number INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS invoices (
+		number TEXT PRIMARY KEY,
+		sequence INTEGER NOT NULL,
+		company TEXT NOT NULL,
+		batch_id TEXT NOT NULL,
+		period_from DATE NOT NULL,
+		period_to DATE NOT NULL,
+		issue_date DATE NOT NULL,
+		due_date DATE NOT NULL,
+		currency TEXT NOT NULL,
+		total_hours REAL NOT NULL,
+		subtotal REAL NOT NULL,
+		discount REAL NOT NULL,
+		tax REAL NOT NULL,
+		total REAL NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS company_billing (
+		company TEXT PRIMARY KEY,
+		settings TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS exchange_rates (
+		base TEXT NOT NULL,
+		quote TEXT NOT NULL,
+		rate REAL NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (base, quote)
+	);
+
+	CREATE TABLE IF NOT EXISTS employees (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		role TEXT NOT NULL,
+		default_rate REAL NOT NULL,
+		currency TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS clients (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		legal_name TEXT NOT NULL,
+		address TEXT NOT NULL,
+		tax_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		payment_terms_days INTEGER NOT NULL,
+		po_number TEXT NOT NULL,
+		template TEXT NOT NULL DEFAULT '',
+		locale TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS client_aliases (
+		name TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS invoice_templates (
+		name TEXT PRIMARY KEY,
+		template TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_clients_name ON clients (lower(name));
+	CREATE INDEX IF NOT EXISTS idx_client_aliases_client ON client_aliases (client_id);
+	CREATE INDEX IF NOT EXISTS idx_invoices_company ON invoices (company);
+	CREATE INDEX IF NOT EXISTS idx_time_entries_company ON time_entries (company, work_date);
+	CREATE INDEX IF NOT EXISTS idx_time_entries_batch ON time_entries (batch_id);
+
+	DROP VIEW IF EXISTS company_employees;
+	CREATE VIEW company_employees AS
+	SELECT
+		batch_id,
+		company,
+		employee_id,
+		billable_rate,
+		currency,
+		SUM(hours) AS worked_hours,
+		SUM(hours * billable_rate) AS worked_cost
+	FROM time_entries
+	GROUP BY batch_id, company, employee_id, billable_rate, currency;`
+
+	if _, err = DB.Exec(schema); err != nil {
+		return fmt.Errorf("failed to run migration: %w", err)
+	}
+	return nil
+}
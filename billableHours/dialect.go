@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// csv dialects:
+// - an uploaded CSV file is decoded to UTF-8 first: a byte order mark names its encoding (UTF-8,
+//   UTF-16LE or UTF-16BE); without one, zero bytes in every other position mean UTF-16, and text that
+//   is not valid UTF-8 is read as Latin-1 (Windows-1252, as spreadsheets write it)
+// - the delimiter is the candidate (comma, semicolon, tab or pipe) that splits the header into several
+//   fields and the most of the first rows into as many
+// - some hand exports quote each whole row as a single field ("1,300,Google,..."); when the header is
+//   quoted like that, every row is unwrapped before it is split
+// - any of these can be given per upload instead, and the dialect used is reported back
+// - semicolons separate fields where a comma is the decimal mark, so numbers in those files may be
+//   written with a decimal comma and dots between thousands (100,5 or 1.234,5)
+
+// encodings
+const (
+	EncodingUTF8 = "utf-8"
+	// EncodingUTF16 is UTF-16 in the byte order its byte order mark gives
+	EncodingUTF16   = "utf-16"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+)
+
+// encodingAliases maps the accepted encoding names to their encoding
+var encodingAliases = map[string]string{
+	"utf-8":        EncodingUTF8,
+	"utf8":         EncodingUTF8,
+	"utf-16":       EncodingUTF16,
+	"utf16":        EncodingUTF16,
+	"utf-16le":     EncodingUTF16LE,
+	"utf16le":      EncodingUTF16LE,
+	"utf-16be":     EncodingUTF16BE,
+	"utf16be":      EncodingUTF16BE,
+	"latin-1":      EncodingLatin1,
+	"latin1":       EncodingLatin1,
+	"iso-8859-1":   EncodingLatin1,
+	"windows-1252": EncodingLatin1,
+	"cp1252":       EncodingLatin1,
+}
+
+// quoting styles
+const (
+	// QuoteStandard quotes individual fields, as RFC 4180 does
+	QuoteStandard = "standard"
+	// QuoteLine quotes each whole row as a single field
+	QuoteLine = "line"
+)
+
+// delimiterCandidates are the delimiters tried when detecting a dialect, in order of preference
+var delimiterCandidates = []rune{',', ';', '\t', '|'}
+
+// delimiterNames are the names accepted for delimiters that are awkward to send
+var delimiterNames = map[string]string{
+	"comma":     ",",
+	"semicolon": ";",
+	"tab":       "\t",
+	`\t`:        "\t",
+	"pipe":      "|",
+}
+
+// dialectSample is the number of lines looked at when detecting a dialect
+const dialectSample = 20
+
+// CSVDialect describes how a CSV file is written. Empty fields are detected.
+type CSVDialect struct {
+	Encoding  string
+	Delimiter string
+	Quoting   string
+}
+
+// parseDialect reads the dialect overrides of an upload, accepting names and aliases
+func parseDialect(delimiter, encoding, quoting string) (CSVDialect, error) {
+	var d CSVDialect
+	if delimiter != "" {
+		if name, ok := delimiterNames[strings.ToLower(strings.TrimSpace(delimiter))]; ok {
+			delimiter = name
+		}
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+			return CSVDialect{}, fmt.Errorf("delimiter must be a single character, or comma, semicolon, tab or pipe, got %q", delimiter)
+		}
+		d.Delimiter = delimiter
+	}
+
+	if encoding != "" {
+		name, ok := encodingAliases[strings.ToLower(strings.TrimSpace(encoding))]
+		if !ok {
+			return CSVDialect{}, fmt.Errorf("encoding must be %s, %s, %s, %s or %s, got %q", EncodingUTF8, EncodingUTF16, EncodingUTF16LE, EncodingUTF16BE, EncodingLatin1, encoding)
+		}
+		d.Encoding = name
+	}
+
+	switch q := strings.ToLower(strings.TrimSpace(quoting)); q {
+	case "", QuoteStandard, QuoteLine:
+		d.Quoting = q
+	default:
+		return CSVDialect{}, fmt.Errorf("quoting must be %s or %s, got %q", QuoteStandard, QuoteLine, quoting)
+	}
+	return d, nil
+}
+
+// delimiter is the dialect's delimiter as a rune
+func (d CSVDialect) delimiter() rune {
+	r, _ := utf8.DecodeRuneInString(d.Delimiter)
+	return r
+}
+
+// parseNumber parses a number field of a file in the dialect, accepting a decimal comma
+// in files separated by semicolons
+func (d CSVDialect) parseNumber(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if d.Delimiter == ";" && strings.Contains(value, ",") {
+		value = strings.ReplaceAll(strings.ReplaceAll(value, ".", ""), ",", ".")
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// csvSource reads the records of a CSV file in its dialect, with their line numbers
+type csvSource struct {
+	reader  *csv.Reader
+	dialect CSVDialect
+}
+
+// openCSV reads a whole CSV file, decoding it and detecting the parts of its dialect
+// the override leaves empty
+func openCSV(r io.Reader, override CSVDialect) (*csvSource, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	dialect := override
+	switch dialect.Encoding {
+	case "":
+		dialect.Encoding = detectEncoding(data)
+	case EncodingUTF16:
+		dialect.Encoding = utf16ByteOrder(data)
+	}
+	text, err := decodeText(data, dialect.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialect.Delimiter == "" || dialect.Quoting == "" {
+		delimiter, quoting := detectLayout(sampleLines(text), dialect)
+		dialect.Delimiter, dialect.Quoting = string(delimiter), quoting
+	}
+
+	return &csvSource{reader: newCSVReader(strings.NewReader(text), dialect.delimiter()), dialect: dialect}, nil
+}
+
+// Read returns the next record and its line number, unwrapping rows quoted as a whole.
+// It returns io.EOF at the end of the file, and a *csv.ParseError for a malformed row.
+func (s *csvSource) Read() ([]string, int, error) {
+	record, err := s.reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := s.reader.FieldPos(0)
+
+	if s.dialect.Quoting == QuoteLine && len(record) == 1 {
+		inner, err := newCSVReader(strings.NewReader(record[0]), s.dialect.delimiter()).Read()
+		if err != nil {
+			if parseErr, ok := err.(*csv.ParseError); ok {
+				err = parseErr.Err
+			}
+			return nil, line, &csv.ParseError{StartLine: line, Line: line, Err: err}
+		}
+		record = inner
+	}
+	return record, line, nil
+}
+
+// newCSVReader returns a CSV reader for the delimiter that allows rows of any length
+func newCSVReader(r io.Reader, delimiter rune) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	// leading space would swallow tabs, and with them empty fields
+	reader.TrimLeadingSpace = delimiter != '\t'
+	return reader
+}
+
+// detectEncoding guesses the encoding of a file from its byte order mark, or its bytes
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return EncodingUTF8
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return EncodingUTF16BE
+	}
+
+	// mostly ASCII text in UTF-16 has a zero in every other byte
+	sample := data[:min(len(data), 4096)]
+	var even, odd int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	switch {
+	case odd > len(sample)/4:
+		return EncodingUTF16LE
+	case even > len(sample)/4:
+		return EncodingUTF16BE
+	case utf8.Valid(data):
+		return EncodingUTF8
+	default:
+		return EncodingLatin1
+	}
+}
+
+// utf16ByteOrder picks the byte order of a UTF-16 file from its byte order mark, or its bytes,
+// falling back to big-endian as the Unicode standard does
+func utf16ByteOrder(data []byte) string {
+	if encoding := detectEncoding(data); encoding == EncodingUTF16LE {
+		return EncodingUTF16LE
+	}
+	return EncodingUTF16BE
+}
+
+// decodeText decodes a file in the encoding to UTF-8, dropping any byte order mark
+func decodeText(data []byte, encoding string) (string, error) {
+	var decoded []byte
+	var err error
+	switch encoding {
+	case EncodingUTF8:
+		decoded = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+		if !utf8.Valid(decoded) {
+			return "", fmt.Errorf("file is not valid %s", EncodingUTF8)
+		}
+	case EncodingUTF16LE:
+		decoded, err = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder().Bytes(data)
+	case EncodingUTF16BE:
+		decoded, err = unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder().Bytes(data)
+	case EncodingLatin1:
+		decoded, err = charmap.Windows1252.NewDecoder().Bytes(data)
+	default:
+		return "", fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decode file as %s: %w", encoding, err)
+	}
+	return strings.TrimPrefix(string(decoded), "\ufeff"), nil
+}
+
+// sampleLines returns the first non-blank lines of a file, for detecting its layout
+func sampleLines(text string) []string {
+	var lines []string
+	for line := range strings.Lines(text) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+		if len(lines) == dialectSample {
+			break
+		}
+	}
+	return lines
+}
+
+// detectLayout picks the delimiter and quoting style that fit the sample lines best,
+// keeping those the dialect already sets. Without a better fit it is comma separated.
+func detectLayout(lines []string, dialect CSVDialect) (rune, string) {
+	candidates := delimiterCandidates
+	if dialect.Delimiter != "" {
+		candidates = []rune{dialect.delimiter()}
+	}
+
+	if dialect.Quoting != QuoteLine {
+		if delimiter, ok := bestDelimiter(lines, candidates); ok || dialect.Quoting == QuoteStandard {
+			return delimiter, QuoteStandard
+		}
+	}
+
+	// every row might be quoted as a single field
+	unwrapped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		record, err := newCSVReader(strings.NewReader(line), ',').Read()
+		if err != nil || len(record) != 1 {
+			break
+		}
+		unwrapped = append(unwrapped, record[0])
+	}
+	if len(unwrapped) > 0 {
+		if delimiter, ok := bestDelimiter(unwrapped, candidates); ok || dialect.Quoting == QuoteLine {
+			return delimiter, QuoteLine
+		}
+	}
+	return candidates[0], cmp.Or(dialect.Quoting, QuoteStandard)
+}
+
+// bestDelimiter picks the candidate that splits the header into several fields and the most rows
+// into as many, preferring earlier candidates on ties. It reports false when none splits the header.
+func bestDelimiter(lines []string, candidates []rune) (rune, bool) {
+	best, bestRows, found := candidates[0], 0, false
+	for _, delimiter := range candidates {
+		reader := newCSVReader(strings.NewReader(strings.Join(lines, "\n")), delimiter)
+		reader.LazyQuotes = true
+		header, err := reader.Read()
+		if err != nil || len(header) < 2 {
+			continue
+		}
+
+		rows := 1
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err == nil && len(record) == len(header) {
+				rows++
+			}
+		}
+		if rows > bestRows {
+			best, bestRows, found = delimiter, rows, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// merged uploads:
+// - every upload is stored as its own batch next to the time entries already stored; a merge
+//   (ModeMerge) also skips the entries already there, so a month can be re-uploaded as it grows
+// - an entry is a duplicate when the same employee already has one for the same company, date, start
+//   and end, whether earlier in the same file or in a stored batch
+// - duplicates are skipped rather than billed twice, and each is reported with the line or batch it repeats;
+//   a merge with nothing new is rejected and creates no batch
+// - the check and the insert share a transaction, and transactions run one at a time on the single
+//   connection (see db.go), so concurrent merges of the same rows store them once
+
+// entryKey identifies a time entry for duplicate detection
+type entryKey struct {
+	EmployeeID int
+	Company    string
+	Date       string
+	Start      int64
+	End        int64
+}
+
+// keyOf returns the duplicate detection key of an entry
+func keyOf(e TimeEntry) entryKey {
+	return entryKey{e.EmployeeID, e.Company, e.Date.Format(dateLayout), e.Start.Unix(), e.End.Unix()}
+}
+
+// mergeBatch stores the entries not already uploaded as a new batch, returning the batch,
+// the entries stored and a problem for each duplicate. lines holds the line number of each entry.
+func mergeBatch(filename string, entries []TimeEntry, lines []int) (Batch, []TimeEntry, []RowError, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return Batch{}, nil, nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	entries, duplicates, err := dropDuplicates(tx, entries, lines)
+	if err != nil {
+		return Batch{}, nil, nil, err
+	}
+	if len(entries) == 0 {
+		if len(duplicates) > 0 {
+			return Batch{}, nil, nil, &ValidationError{Errors: duplicates}
+		}
+		return Batch{}, nil, nil, fmt.Errorf("no time entries to merge")
+	}
+
+	batch, err := insertBatch(tx, filename, entries)
+	if err != nil {
+		return Batch{}, nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Batch{}, nil, nil, fmt.Errorf("failed to commit batch: %w", err)
+	}
+	return batch, entries, duplicates, nil
+}
+
+// dropDuplicates removes the entries already stored, or repeated earlier in the upload,
+// returning the entries left and a problem for each duplicate
+func dropDuplicates(tx *sql.Tx, entries []TimeEntry, lines []int) ([]TimeEntry, []RowError, error) {
+	stored, err := storedEntryKeys(tx, entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	duplicates := []RowError{}
+	seen := make(map[entryKey]int, len(entries))
+	kept := entries[:0:0]
+	for i, e := range entries {
+		key := keyOf(e)
+		value := fmt.Sprintf("%d %s %s %s-%s", e.EmployeeID, e.Company, key.Date, e.Start.Format(clockLayout), e.End.Format(clockLayout))
+		if batch, ok := stored[key]; ok {
+			duplicates = append(duplicates, RowError{Line: lines[i], Value: value, Reason: "duplicate of an entry already uploaded in batch " + batch})
+			continue
+		}
+		if line, ok := seen[key]; ok {
+			duplicates = append(duplicates, RowError{Line: lines[i], Value: value, Reason: fmt.Sprintf("duplicate of line %d", line)})
+			continue
+		}
+		seen[key] = lines[i]
+		kept = append(kept, e)
+	}
+	return kept, duplicates, nil
+}
+
+// storedEntryKeys returns the keys of the stored entries that could duplicate the entries,
+// with the batch each was uploaded in
+func storedEntryKeys(tx *sql.Tx, entries []TimeEntry) (map[entryKey]string, error) {
+	// only the stored entries for the same companies, in the dates the upload covers, can match
+	type span struct{ from, to time.Time }
+	spans := make(map[string]span)
+	for _, e := range entries {
+		s, ok := spans[e.Company]
+		if !ok || e.Date.Before(s.from) {
+			s.from = e.Date
+		}
+		if !ok || e.Date.After(s.to) {
+			s.to = e.Date
+		}
+		spans[e.Company] = s
+	}
+
+	keys := make(map[entryKey]string)
+	for _, company := range sortedKeys(spans) {
+		rows, err := tx.Query(`
+			SELECT batch_id, employee_id, company, work_date, start_time, end_time
+			FROM time_entries
+			WHERE company = ? AND work_date >= ? AND work_date <= ?
+		`, company, spans[company].from, spans[company].to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stored time entries: %w", err)
+		}
+		for rows.Next() {
+			var batch string
+			var e TimeEntry
+			if err := rows.Scan(&batch, &e.EmployeeID, &e.Company, &e.Date, &e.Start, &e.End); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read stored time entry: %w", err)
+			}
+			keys[keyOf(e)] = batch
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stored time entries: %w", err)
+		}
+	}
+	return keys, nil
+}
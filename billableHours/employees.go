@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// employee directory:
+// - names the employee IDs found in uploads, so invoices can show who did the work
+// - managed through the API one employee at a time, or in bulk from a CSV file
+// - invoices print each employee's name and role; IDs without a directory entry are still
+//   billed, but are flagged on the invoice (and listed in InvoiceDocument.UnknownEmployees)
+// - DefaultRate is informational: entries are always billed at the rate they were uploaded with
+
+// StaffMember is an employee directory entry
+type StaffMember struct {
+	ID          int
+	Name        string
+	Role        string
+	DefaultRate float64
+	Currency    string
+	UpdatedAt   time.Time
+}
+
+// validate checks a directory entry before it is stored
+func (s StaffMember) validate() error {
+	if s.ID <= 0 {
+		return fmt.Errorf("employee id must be positive, got %d", s.ID)
+	}
+	if s.Name == "" {
+		return fmt.Errorf("employee %d: name is required", s.ID)
+	}
+	if s.DefaultRate < 0 {
+		return fmt.Errorf("employee %d: default rate must not be negative", s.ID)
+	}
+	if s.Currency != "" && !isCurrencyCode(s.Currency) {
+		return fmt.Errorf("employee %d: invalid currency %q, expected a 3-letter currency code", s.ID, s.Currency)
+	}
+	return nil
+}
+
+// saveStaff creates or replaces directory entries in a single transaction
+func saveStaff(staff []StaffMember) ([]StaffMember, error) {
+	now := time.Now()
+	for i := range staff {
+		staff[i].Name = strings.TrimSpace(staff[i].Name)
+		staff[i].Role = strings.TrimSpace(staff[i].Role)
+		staff[i].Currency = normalizeCurrency(staff[i].Currency)
+		staff[i].UpdatedAt = now
+		if err := staff[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, s := range staff {
+		_, err := tx.Exec(`
+			INSERT INTO employees (id, name, role, default_rate, currency, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name,
+				role = excluded.role,
+				default_rate = excluded.default_rate,
+				currency = excluded.currency,
+				updated_at = excluded.updated_at
+		`, s.ID, s.Name, s.Role, s.DefaultRate, s.Currency, s.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save employee: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit employees: %w", err)
+	}
+	return staff, nil
+}
+
+// getStaffMember looks up a directory entry by employee ID
+func getStaffMember(id int) (StaffMember, error) {
+	var s StaffMember
+	err := DB.QueryRow(`
+		SELECT id, name, role, default_rate, currency, updated_at
+		FROM employees
+		WHERE id = ?
+	`, id).Scan(&s.ID, &s.Name, &s.Role, &s.DefaultRate, &s.Currency, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return StaffMember{}, fmt.Errorf("employee %d not found", id)
+	}
+	if err != nil {
+		return StaffMember{}, fmt.Errorf("failed to load employee: %w", err)
+	}
+	return s, nil
+}
+
+// listStaff returns the employee directory by ID
+func listStaff() ([]StaffMember, error) {
+	rows, err := DB.Query(`
+		SELECT id, name, role, default_rate, currency, updated_at
+		FROM employees
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list employees: %w", err)
+	}
+	defer rows.Close()
+
+	staff := []StaffMember{}
+	for rows.Next() {
+		var s StaffMember
+		if err := rows.Scan(&s.ID, &s.Name, &s.Role, &s.DefaultRate, &s.Currency, &s.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read employee: %w", err)
+		}
+		staff = append(staff, s)
+	}
+	return staff, rows.Err()
+}
+
+// staffDirectory returns the employee directory keyed by employee ID
+func staffDirectory() (map[int]StaffMember, error) {
+	staff, err := listStaff()
+	if err != nil {
+		return nil, err
+	}
+	directory := make(map[int]StaffMember, len(staff))
+	for _, s := range staff {
+		directory[s.ID] = s
+	}
+	return directory, nil
+}
+
+// deleteStaffMember removes a directory entry; the employee's time entries are kept
+func deleteStaffMember(id int) error {
+	res, err := DB.Exec(`DELETE FROM employees WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete employee: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("employee %d not found", id)
+	}
+	return nil
+}
+
+// readStaff reads directory entries from CSV with Employee ID, Name, Role, Default Rate
+// and Currency columns, in any dialect openCSV detects; Role, Default Rate and Currency may be
+// left out or empty
+func readStaff(reader io.Reader) ([]StaffMember, error) {
+	src, err := openCSV(reader, CSVDialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	// skip header
+	if _, _, err := src.Read(); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	var staff []StaffMember
+	for {
+		record, line, err := src.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: invalid record: expected >=2 fields, got %d", line, len(record))
+		}
+		field := func(i int) string {
+			if i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		id, err := strconv.Atoi(field(0))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid employee id %q", line, record[0])
+		}
+		s := StaffMember{ID: id, Name: field(1), Role: field(2), Currency: field(4)}
+		if rate := field(3); rate != "" {
+			s.DefaultRate, err = src.dialect.parseNumber(rate)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid default rate %q", line, rate)
+			}
+		}
+		staff = append(staff, s)
+	}
+	return staff, nil
+}
+
+// employeeLabel names an employee on an invoice, falling back to the ID
+func employeeLabel(id int, name string) string {
+	if name == "" {
+		return fmt.Sprintf("Employee %d", id)
+	}
+	return name
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bulk export:
+// - invoice the chosen companies, or every company with entries in the period
+// - build every invoice first, so a company that cannot be invoiced fails the export before anything is sent
+// - number and render them together (see renderInvoices), then stream them as one ZIP
+// - manifest.csv lists each company with its invoice number, total and file name
+// - file names are made unique with a numeric suffix, as companies whose names differ only in characters
+//   that are not safe in file names ("a b" and "a_b") would otherwise share one
+
+// exportManifest is the name of the summary file in an invoice export
+const exportManifest = "manifest.csv"
+
+// buildExport builds the invoices for the named companies (by name or client ID),
+// or for every company with entries matching the filter when none are named
+func buildExport(companies []string, filter EntryFilter, opts InvoiceOptions) ([]InvoiceDocument, error) {
+	if len(companies) == 0 {
+		var err error
+		companies, err = listCompanies(filter)
+		if err != nil {
+			return nil, err
+		}
+		if len(companies) == 0 {
+			return nil, fmt.Errorf("no entries found to invoice")
+		}
+	}
+
+	// companies named twice, or by both client ID and name, are invoiced once
+	var docs []InvoiceDocument
+	var seen []string
+	for _, company := range companies {
+		if strings.TrimSpace(company) == "" {
+			continue
+		}
+
+		doc, err := buildInvoice(company, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(seen, doc.Company) {
+			continue
+		}
+		seen = append(seen, doc.Company)
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// writeExport streams rendered invoices to w as a ZIP archive, followed by the manifest
+func writeExport(w io.Writer, invoices []renderedInvoice) error {
+	archive := zip.NewWriter(w)
+	now := time.Now()
+
+	manifest := [][]string{{"Company", "Invoice Number", "File", "Period From", "Period To", "Currency", "Total Hours", "Total"}}
+	used := map[string]bool{exportManifest: true}
+	for _, out := range invoices {
+		name := uniqueName(out.Filename, used)
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to export: %w", name, err)
+		}
+		if _, err := f.Write(out.Content); err != nil {
+			return fmt.Errorf("failed to write %s to export: %w", name, err)
+		}
+
+		number := out.Number
+		if number == "" {
+			number = "DRAFT"
+		}
+		manifest = append(manifest, []string{
+			out.Company,
+			number,
+			name,
+			out.PeriodFrom.Format(dateLayout),
+			out.PeriodTo.Format(dateLayout),
+			out.Currency,
+			strconv.FormatFloat(out.TotalHours, 'f', 2, 64),
+			strconv.FormatFloat(out.Total, 'f', 2, 64),
+		})
+	}
+
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: exportManifest, Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return fmt.Errorf("failed to add manifest to export: %w", err)
+	}
+	if err := csv.NewWriter(f).WriteAll(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return archive.Close()
+}
+
+// uniqueName returns the file name, or when it is already used the name with the first free
+// numeric suffix before its extension, and marks the name returned as used
+func uniqueName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	unique := name
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[unique] = true
+	return unique
+}
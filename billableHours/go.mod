@@ -4,4 +4,20 @@ go 1.24.4
 
 require github.com/gorilla/mux v1.8.1
 
-require codeberg.org/go-pdf/fpdf v0.11.1 // indirect
+require (
+	codeberg.org/go-pdf/fpdf v0.11.1
+	github.com/google/uuid v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/xuri/excelize/v2 v2.10.0
+	golang.org/x/text v0.30.0
+)
+
+require (
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.4 // indirect
+	github.com/tiendc/go-deepcopy v1.7.1 // indirect
+	github.com/xuri/efp v0.0.1 // indirect
+	github.com/xuri/nfp v0.0.2-0.20250530014748-2ddeb826f9a9 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/net v0.46.0 // indirect
+)
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+)
+
+// htmlRenderer lays the invoice out as a standalone HTML page, styled like the PDF
+type htmlRenderer struct{}
+
+func (htmlRenderer) ContentType() string { return "text/html; charset=utf-8" }
+func (htmlRenderer) Extension() string   { return "html" }
+
+func (htmlRenderer) Render(w io.Writer, doc InvoiceDocument) error {
+	tpl := doc.template.withDefaults()
+	table := layoutTable(doc)
+
+	// the template's values are validated when it is saved, so they are safe in CSS and URLs
+	var logo template.URL
+	if len(tpl.Logo) > 0 {
+		logo = template.URL("data:" + http.DetectContentType(tpl.Logo) + ";base64," + base64.StdEncoding.EncodeToString(tpl.Logo))
+	}
+	paper := "A4"
+	if tpl.PaperSize == PaperLetter {
+		paper = "letter"
+	}
+
+	return htmlInvoice.Execute(w, struct {
+		InvoiceDocument
+		InvoiceNumber string
+		Table         invoiceTable
+		TotalRows     []totalRow
+		// the totals block sits under the last two columns
+		BlankColumns int
+		UnknownNote  string
+		BillTo       []string
+		PONumber     string
+		Logo         template.URL
+		Footer       []string
+		Font         template.CSS
+		Accent       template.CSS
+		HeaderText   template.CSS
+		Text         template.CSS
+		Paper        template.CSS
+	}{
+		doc, invoiceNumber(doc), table, totalRows(doc.Totals), len(table.Columns) - 2,
+		unknownNote(doc), billTo(doc), poNumber(doc), logo, footerLines(tpl),
+		template.CSS(templateFonts[tpl.Font]), template.CSS(tpl.AccentColor), template.CSS(tpl.HeaderTextColor),
+		template.CSS(tpl.TextColor), template.CSS(paper),
+	})
+}
+
+// htmlInvoice is the invoice page template
+var htmlInvoice = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"date":  func(t time.Time) string { return t.Format(dateLayout) },
+	"money": formatMoney,
+	"label": currencyLabel,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.InvoiceNumber}} - {{.CompanyName}}</title>
+<style>
+@page { size: {{.Paper}}; }
+body { font-family: {{.Font}}; color: {{.Text}}; margin: 2em; }
+header { display: flex; justify-content: space-between; align-items: flex-start; }
+header img { max-height: 4em; }
+h1 { font-size: 1.5em; font-weight: normal; }
+dl { display: grid; grid-template-columns: max-content 1fr max-content 1fr; gap: 0.25em 1em; }
+dt { font-weight: bold; }
+h2 { font-size: 1em; margin-bottom: 0.25em; }
+address { font-style: normal; }
+table { border-collapse: collapse; margin-top: 2em; min-width: 60%; }
+th { background: {{.Accent}}; color: {{.HeaderText}}; text-align: left; }
+th, td { border: 1px solid {{.Text}}; padding: 0.3em 0.6em; }
+td { text-align: right; }
+tr.group td, tr.section td { text-align: left; font-weight: bold; }
+tr.subtotal td { font-style: italic; }
+tr.section-subtotal td { font-weight: bold; }
+tr.total td { font-weight: bold; }
+thead { display: table-header-group; }
+tfoot { display: table-row-group; break-inside: avoid; }
+tr { break-inside: avoid; }
+p.note { font-style: italic; font-size: 0.85em; }
+footer { margin-top: 3em; font-size: 0.85em; text-align: center; }
+</style>
+</head>
+<body>
+<header>
+<h1>Company: {{.CompanyName}}</h1>
+{{- if .Logo}}
+<img src="{{.Logo}}" alt="">
+{{- end}}
+</header>
+<dl>
+<dt>Invoice No</dt><dd>{{.InvoiceNumber}}</dd>
+<dt>Issue Date</dt><dd>{{date .IssueDate}}</dd>
+<dt>Period</dt><dd>{{date .PeriodFrom}} to {{date .PeriodTo}}</dd>
+<dt>Due Date</dt><dd>{{date .DueDate}}</dd>
+<dt>Currency</dt><dd>{{label .Currency}}</dd>
+{{- if .PONumber}}
+<dt>PO Number</dt><dd>{{.PONumber}}</dd>
+{{- end}}
+</dl>
+{{- if .BillTo}}
+<h2>Bill To</h2>
+<address>
+{{- range $i, $line := .BillTo}}{{if $i}}<br>{{end}}
+{{$line}}
+{{- end}}
+</address>
+{{- end}}
+{{- $currency := .Currency}}
+<table>
+<thead><tr>{{range .Table.Columns}}<th>{{.Title}}</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Table.Rows}}
+{{- if or (eq .Kind "group") (eq .Kind "section")}}
+<tr class="{{.Kind}}"><td colspan="{{len $.Table.Columns}}">{{index .Cells 0}}</td></tr>
+{{- else}}
+<tr class="{{.Kind}}">{{range .Cells}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+{{- end}}
+</tbody>
+<tfoot>
+{{- range .TotalRows}}
+<tr class="{{.Kind}}">{{if $.BlankColumns}}<td colspan="{{$.BlankColumns}}"></td>{{end}}<td>{{.Label}}</td><td>{{money .Amount $currency}}</td></tr>
+{{- end}}
+</tfoot>
+</table>
+{{- if .UnknownNote}}
+<p class="note">{{.UnknownNote}}</p>
+{{- end}}
+{{- if .Footer}}
+<footer>
+{{- range $i, $line := .Footer}}{{if $i}}<br>{{end}}
+{{$line}}
+{{- end}}
+</footer>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// invoices:
+// - buildInvoice loads a company's entries and turns them into an InvoiceDocument:
+//   the register record, one line per employee and rate, the itemised entries and the totals
+// - every amount in the document is already converted into the invoice currency and rounded
+// - renderers (see render.go) only lay the document out; they never touch the database
+// - renderInvoices numbers documents, records them in the invoice register and renders them
+//   in memory; issued invoices are also kept in the storage directory when one is set (see storage.go)
+// - an invoice is issued once: downloading the same company, batch and period again while its figures
+//   are unchanged returns the invoice already in the register, with its number and dates
+// - generateInvoice does this for a single company, exportInvoices (see export.go) for many
+
+// InvoiceOptions controls how an invoice is laid out
+type InvoiceOptions struct {
+	// Itemised lists every time entry grouped under its employee,
+	// instead of one summary row per employee
+	Itemised bool
+	// Draft renders the invoice without issuing a number or recording it in the register
+	Draft bool
+	// Format names the renderer to use, see renderers; empty means PDF
+	Format string
+	// SortBy, Order and GroupBy set the order employees are listed in, see ordering.go
+	SortBy  string
+	Order   string
+	GroupBy string
+}
+
+// Invoice is an issued invoice as recorded in the invoice register
+type Invoice struct {
+	Number     string
+	Sequence   int
+	Company    string
+	BatchID    string
+	PeriodFrom time.Time
+	PeriodTo   time.Time
+	IssueDate  time.Time
+	DueDate    time.Time
+	Currency   string
+	TotalHours float64
+	Subtotal   float64
+	Discount   float64
+	Tax        float64
+	Total      float64
+	CreatedAt  time.Time
+}
+
+// InvoiceDocument is everything a renderer needs to lay out an invoice
+type InvoiceDocument struct {
+	Invoice
+	// CompanyName is the company for display: the client's legal name, or the company as it was asked for
+	CompanyName string
+	// Client holds the bill-to details from the client directory, nil for companies without a record
+	Client   *Client
+	Draft    bool
+	Itemised bool
+	// Rounded is set when the company has a rounding policy, so worked and billed hours may differ
+	Rounded bool
+	// Premiums is set when some hours are billed at a premium, so lines have a rate type
+	Premiums bool
+	// UnknownEmployees lists the employee IDs with no entry in the employee directory
+	UnknownEmployees []int
+	// RawHours are the hours worked; TotalHours the hours billed
+	RawHours float64
+	// Lines holds one line per employee and rate, in employee order
+	Lines []InvoiceLine
+	// Groups holds every time entry under its employee, in employee then date order
+	Groups []EntryGroup
+	// Sections subtotals the employees by section when the invoice is grouped, in order
+	Sections []InvoiceSection
+	Totals   Totals
+	// template brands the PDF and HTML layouts; it is not part of the invoice model
+	template InvoiceTemplate
+}
+
+// InvoiceLine is the time an employee billed at a single rate: Hours billed, RawHours worked.
+// Rate is in RateCurrency, before the premium Multiplier; UnitPrice and Cost are in the
+// invoice currency, after it. Type names the premium, "Regular" for regular hours.
+// EmployeeName and EmployeeRole come from the employee directory and are empty for unknown IDs.
+// Section is the group the employee is listed under, empty when the invoice is not grouped.
+type InvoiceLine struct {
+	EmployeeID   int
+	EmployeeName string
+	EmployeeRole string
+	Section      string
+	Type         string
+	Premium      string
+	Multiplier   float64
+	Hours        float64
+	RawHours     float64
+	Rate         float64
+	RateCurrency string
+	UnitPrice    float64
+	Cost         float64
+}
+
+// EntryGroup holds an employee's time entries and their subtotal
+type EntryGroup struct {
+	EmployeeID   int
+	EmployeeName string
+	EmployeeRole string
+	Section      string
+	Entries      []EntryLine
+	Hours        float64
+	RawHours     float64
+	Cost         float64
+}
+
+// EntryLine is a single time entry on an itemised invoice: Hours billed, RawHours worked.
+// An entry with premium hours has a line for each portion, priced like InvoiceLine.
+type EntryLine struct {
+	Date         time.Time
+	Start        time.Time
+	End          time.Time
+	Type         string
+	Premium      string
+	Multiplier   float64
+	Hours        float64
+	RawHours     float64
+	Rate         float64
+	RateCurrency string
+	Cost         float64
+}
+
+// invoice numbering and payment terms, overridable through the environment in main
+var (
+	invoicePrefix    = "INV-"
+	paymentTermsDays = 30
+)
+
+// buildInvoice builds the invoice model for the specified company from the
+// entries selected by the filter. The document is not numbered yet.
+func buildInvoice(companyName string, filter EntryFilter, opts InvoiceOptions) (InvoiceDocument, error) {
+	if err := opts.validateOrdering(); err != nil {
+		return InvoiceDocument{}, err
+	}
+
+	// the company may be asked for by client ID as well as by name
+	client, known, err := findClient(companyName)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+	displayName := strings.TrimSpace(companyName)
+	if known {
+		companyName, displayName = client.Name, client.DisplayName()
+	}
+	cName := strings.TrimSpace(strings.ToLower(companyName))
+	filter.Company = cName
+	if known {
+		// entries uploaded before a rename are still the client's
+		filter.Aliases, err = clientAliases(client.ID)
+		if err != nil {
+			return InvoiceDocument{}, err
+		}
+	}
+
+	entries, err := loadEntries(filter)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+
+	settings, err := getBillingSettings(cName)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+	if err := billStoredEntries(entries, filter, settings); err != nil {
+		return InvoiceDocument{}, err
+	}
+
+	employees, exists := rollup(entries)[cName]
+	if !exists {
+		if !filter.From.IsZero() || !filter.To.IsZero() {
+			return InvoiceDocument{}, fmt.Errorf("no entries found for company %s in the selected period", cName)
+		}
+		return InvoiceDocument{}, fmt.Errorf("company %s not found", cName)
+	}
+	from, to := invoicePeriod(filter, entries)
+
+	// bring every line into the company's currency
+	conv, err := newConverter(settings.Currency)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+	employees, err = conv.convertEmployees(employees)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+	totals := computeTotals(employees, settings)
+
+	directory, err := staffDirectory()
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+
+	terms := paymentTermsDays
+	if known && client.PaymentTermsDays > 0 {
+		terms = client.PaymentTermsDays
+	}
+	issueDate := truncateDay(time.Now())
+	doc := InvoiceDocument{
+		Invoice: Invoice{
+			Company:    cName,
+			BatchID:    filter.BatchID,
+			PeriodFrom: from,
+			PeriodTo:   to,
+			IssueDate:  issueDate,
+			DueDate:    issueDate.AddDate(0, 0, terms),
+			Currency:   settings.Currency,
+			Subtotal:   totals.Subtotal,
+			Discount:   totals.Discount,
+			Tax:        totals.Tax,
+			Total:      totals.Total,
+		},
+		CompanyName: displayName,
+		Draft:       opts.Draft,
+		Itemised:    opts.Itemised,
+		Rounded:     settings.Rounding != nil,
+		Totals:      totals,
+	}
+	if known {
+		doc.Client = &client
+	}
+	doc.template, err = clientTemplate(doc.Client)
+	if err != nil {
+		return InvoiceDocument{}, err
+	}
+
+	ids := sortEmployees(employees, directory, opts)
+
+	// one line per employee and rate, costs rounded like the totals
+	for _, id := range ids {
+		emp := employees[id]
+		staff, known := directory[id]
+		if !known {
+			doc.UnknownEmployees = append(doc.UnknownEmployees, id)
+		}
+		doc.TotalHours += emp.TotalHours
+		doc.RawHours += emp.RawHours
+		for _, line := range emp.Rates {
+			r, err := conv.rate(line.Currency)
+			if err != nil {
+				return InvoiceDocument{}, fmt.Errorf("employee %d: %w", id, err)
+			}
+			if line.Premium != "" {
+				doc.Premiums = true
+			}
+			doc.Lines = append(doc.Lines, InvoiceLine{
+				EmployeeID:   id,
+				EmployeeName: staff.Name,
+				EmployeeRole: staff.Role,
+				Section:      sectionName(opts, staff),
+				Type:         premiumLabel(line.Premium, line.Multiplier),
+				Premium:      line.Premium,
+				Multiplier:   line.Multiplier,
+				Hours:        line.Hours,
+				RawHours:     line.RawHours,
+				Rate:         line.BillableRate,
+				RateCurrency: line.Currency,
+				UnitPrice:    fromCents(toCents(line.BillableRate * line.Multiplier * r)),
+				Cost:         fromCents(toCents(line.Cost)),
+			})
+		}
+	}
+
+	slices.Sort(doc.UnknownEmployees)
+
+	// every entry under its employee, in date and start time order
+	byEmployee := make(map[int][]TimeEntry)
+	for _, e := range entries {
+		byEmployee[e.EmployeeID] = append(byEmployee[e.EmployeeID], e)
+	}
+	for _, id := range ids {
+		emp := employees[id]
+		slices.SortStableFunc(byEmployee[id], func(a, b TimeEntry) int {
+			return cmp.Or(a.Date.Compare(b.Date), a.Start.Compare(b.Start))
+		})
+		group := EntryGroup{
+			EmployeeID:   id,
+			EmployeeName: directory[id].Name,
+			EmployeeRole: directory[id].Role,
+			Section:      sectionName(opts, directory[id]),
+			Hours:        emp.TotalHours,
+			RawHours:     emp.RawHours,
+			Cost:         lineCost(emp),
+		}
+		for _, e := range byEmployee[id] {
+			currency := e.Currency
+			if currency == "" {
+				currency = conv.target
+			}
+			r, err := conv.rate(currency)
+			if err != nil {
+				return InvoiceDocument{}, fmt.Errorf("employee %d: %w", id, err)
+			}
+			for _, p := range entryPortions(e) {
+				group.Entries = append(group.Entries, EntryLine{
+					Date:         e.Date,
+					Start:        e.Start,
+					End:          e.End,
+					Type:         premiumLabel(p.Kind, p.Multiplier),
+					Premium:      p.Kind,
+					Multiplier:   p.Multiplier,
+					Hours:        p.Hours,
+					RawHours:     rawShare(e, p.Hours),
+					Rate:         e.BillableRate,
+					RateCurrency: currency,
+					Cost:         p.Hours * e.BillableRate * p.Multiplier * r,
+				})
+			}
+		}
+		doc.Groups = append(doc.Groups, group)
+	}
+	doc.Sections = invoiceSections(doc.Groups)
+
+	return doc, nil
+}
+
+// renderedInvoice is an invoice rendered in memory in a single format, ready to be delivered
+type renderedInvoice struct {
+	Invoice
+	Filename string
+	Content  []byte
+}
+
+// generateInvoice renders an invoice for the specified company in the requested
+// format, using only the entries selected by the filter. Unless it is a draft, the
+// invoice is numbered and recorded in the invoice register.
+func generateInvoice(companyName string, filter EntryFilter, opts InvoiceOptions) (renderedInvoice, error) {
+	doc, err := buildInvoice(companyName, filter, opts)
+	if err != nil {
+		return renderedInvoice{}, err
+	}
+
+	rendered, err := renderInvoices([]InvoiceDocument{doc}, opts.Format)
+	if err != nil {
+		return renderedInvoice{}, err
+	}
+	return rendered[0], nil
+}
+
+// renderInvoices numbers the documents that are not drafts and renders them in the
+// format, empty meaning PDF. Numbers are issued in a single transaction that is only
+// committed once every invoice has rendered, so a failure leaves the register untouched.
+func renderInvoices(docs []InvoiceDocument, format string) ([]renderedInvoice, error) {
+	if format == "" {
+		format = "pdf"
+	}
+	renderer, ok := renderers[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported invoice format %q", format)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rendered := make([]renderedInvoice, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.Draft {
+			doc.Invoice, err = issueInvoice(tx, doc.Invoice)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := renderer.Render(&buf, doc); err != nil {
+			return nil, fmt.Errorf("failed to render invoice for %s: %w", doc.Company, err)
+		}
+		rendered = append(rendered, renderedInvoice{
+			Invoice:  doc.Invoice,
+			Filename: invoiceFilename(doc.Company, renderer),
+			Content:  buf.Bytes(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit invoices: %w", err)
+	}
+
+	// the invoices are issued; keeping a copy is best effort
+	for _, out := range rendered {
+		if err := storeInvoice(out); err != nil {
+			log.Printf("failed to store invoice %s: %v", out.Number, err)
+		}
+	}
+	return rendered, nil
+}
+
+// invoiceFilename names a company's invoice file
+func invoiceFilename(company string, renderer Renderer) string {
+	return safeFilename(company) + "_invoice." + renderer.Extension()
+}
+
+// safeFilename replaces every character that is not safe in a file name with an underscore
+func safeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// issueInvoice takes the next number for the invoice prefix and records the invoice
+// in the register, unless the same invoice was issued before, which it returns instead.
+// It runs inside the caller's transaction, so a failed invoice rolls its number back
+// and the sequence stays gap-free.
+func issueInvoice(tx *sql.Tx, inv Invoice) (Invoice, error) {
+	issued, err := scanInvoice(tx.QueryRow(`
+		SELECT `+invoiceColumns+`
+		FROM invoices
+		WHERE company = ? AND batch_id = ? AND period_from = ? AND period_to = ?
+			AND currency = ? AND total_hours = ? AND subtotal = ? AND discount = ? AND tax = ? AND total = ?
+		ORDER BY sequence DESC
+		LIMIT 1
+	`, inv.Company, inv.BatchID, inv.PeriodFrom, inv.PeriodTo, inv.Currency, inv.TotalHours, inv.Subtotal, inv.Discount, inv.Tax, inv.Total))
+	if err == nil {
+		return issued, nil
+	}
+	if err != sql.ErrNoRows {
+		return Invoice{}, fmt.Errorf("failed to look up issued invoice: %w", err)
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO invoice_sequences (prefix, last_number)
+		VALUES (?, 1)
+		ON CONFLICT (prefix) DO UPDATE SET last_number = last_number + 1
+		RETURNING last_number
+	`, invoicePrefix).Scan(&inv.Sequence)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to take invoice number: %w", err)
+	}
+	inv.Number = fmt.Sprintf("%s%05d", invoicePrefix, inv.Sequence)
+	inv.CreatedAt = time.Now()
+
+	_, err = tx.Exec(`
+		INSERT INTO invoices (number, sequence, company, batch_id, period_from, period_to, issue_date, due_date, currency, total_hours, subtotal, discount, tax, total, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, inv.Number, inv.Sequence, inv.Company, inv.BatchID, inv.PeriodFrom, inv.PeriodTo, inv.IssueDate, inv.DueDate, inv.Currency, inv.TotalHours, inv.Subtotal, inv.Discount, inv.Tax, inv.Total, inv.CreatedAt)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to record invoice: %w", err)
+	}
+	return inv, nil
+}
+
+// invoiceColumns are the invoice register columns, in the order scanInvoice reads them
+const invoiceColumns = `number, sequence, company, batch_id, period_from, period_to, issue_date, due_date, currency, total_hours, subtotal, discount, tax, total, created_at`
+
+// scanInvoice reads an invoice register row
+func scanInvoice(row interface{ Scan(...any) error }) (Invoice, error) {
+	var inv Invoice
+	err := row.Scan(&inv.Number, &inv.Sequence, &inv.Company, &inv.BatchID, &inv.PeriodFrom, &inv.PeriodTo,
+		&inv.IssueDate, &inv.DueDate, &inv.Currency, &inv.TotalHours, &inv.Subtotal, &inv.Discount, &inv.Tax, &inv.Total, &inv.CreatedAt)
+	return inv, err
+}
+
+// listInvoices returns the invoice register in number order, optionally for a single company
+func listInvoices(company string) ([]Invoice, error) {
+	query := `SELECT ` + invoiceColumns + ` FROM invoices`
+	var args []any
+	if company != "" {
+		query += " WHERE company = ?"
+		args = append(args, strings.TrimSpace(strings.ToLower(company)))
+	}
+	query += " ORDER BY created_at, sequence"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	defer rows.Close()
+
+	invoices := []Invoice{}
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read invoice: %w", err)
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
+
+// getInvoice looks up an issued invoice by number
+func getInvoice(number string) (Invoice, error) {
+	inv, err := scanInvoice(DB.QueryRow(`SELECT `+invoiceColumns+` FROM invoices WHERE number = ?`, number))
+	if err == sql.ErrNoRows {
+		return Invoice{}, fmt.Errorf("invoice %s not found", number)
+	}
+	if err != nil {
+		return Invoice{}, fmt.Errorf("failed to load invoice: %w", err)
+	}
+	return inv, nil
+}
+
+// invoicePeriod returns the billing period covered by an invoice: the
+// requested bounds, falling back to the earliest/latest entry dates when open
+func invoicePeriod(filter EntryFilter, entries []TimeEntry) (time.Time, time.Time) {
+	from, to := filter.From, filter.To
+	for _, e := range entries {
+		if filter.From.IsZero() && (from.IsZero() || e.Date.Before(from)) {
+			from = e.Date
+		}
+		if filter.To.IsZero() && (to.IsZero() || e.Date.After(to)) {
+			to = e.Date
+		}
+	}
+	return from, to
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 )
 
 func main() {
@@ -16,6 +18,51 @@ func main() {
 		port = "8080"
 	}
 
+	// invoice numbering and payment terms
+	if prefix, ok := os.LookupEnv("INVOICE_PREFIX"); ok {
+		invoicePrefix = prefix
+	}
+	if terms := os.Getenv("PAYMENT_TERMS_DAYS"); terms != "" {
+		days, err := strconv.Atoi(terms)
+		if err != nil || days < 0 {
+			log.Fatal("invalid PAYMENT_TERMS_DAYS: ", terms)
+		}
+		paymentTermsDays = days
+	}
+
+	if currency := os.Getenv("DEFAULT_CURRENCY"); currency != "" {
+		defaultCurrency = normalizeCurrency(currency)
+		if !isCurrencyCode(defaultCurrency) {
+			log.Fatal("invalid DEFAULT_CURRENCY: ", currency)
+		}
+	}
+
+	// invoicing party on structured (UBL) invoices
+	supplierName = os.Getenv("SUPPLIER_NAME")
+
+	// optional storage for issued invoices, with retention rules
+	invoiceStorageDir = os.Getenv("INVOICE_STORAGE_DIR")
+	for name, setting := range map[string]*int{
+		"INVOICE_RETENTION_DAYS":  &invoiceRetentionDays,
+		"INVOICE_RETENTION_COUNT": &invoiceRetentionCount,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				log.Fatal("invalid ", name, ": ", value)
+			}
+			*setting = n
+		}
+	}
+	if err := pruneInvoices(time.Now()); err != nil {
+		log.Printf("failed to apply invoice retention: %v", err)
+	}
+
+	// initialize db
+	if err := InitDB("timesheets.db"); err != nil {
+		log.Fatal("failed to initialize database: ", err)
+	}
+
 	// start server
 	fmt.Println("Server running on port:", port)
 	if err := http.ListenAndServe(":"+port, router); err != nil {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// invoice ordering:
+// - employees are always listed in a fixed order, so two invoices for the same data are laid out the same
+// - SortBy orders them by employee ID (the default), name, billed hours or cost; hours and cost put the
+//   largest first, the others the smallest, unless Order says otherwise. Ties fall back to the employee ID
+// - GroupBy role gathers the employees under a heading per role, in role order, each with a subtotal;
+//   employees without a role come last. Timesheets have a single project column, which names the company
+//   billed, so an invoice covers one project and cannot be grouped by it
+// - each employee's lines keep their rate order, and itemised entries are in date and start time order
+
+// sort keys
+const (
+	SortByID    = "id"
+	SortByName  = "name"
+	SortByHours = "hours"
+	SortByCost  = "cost"
+)
+
+// sortKeys lists every sort key
+var sortKeys = []string{SortByID, SortByName, SortByHours, SortByCost}
+
+// sort orders
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// GroupByRole gathers an invoice's employees by role
+const GroupByRole = "role"
+
+// noRole heads the employees without a role when an invoice is grouped by role
+const noRole = "No role"
+
+// InvoiceSection is a group of employees on an invoice, with their subtotal
+type InvoiceSection struct {
+	Name     string
+	Hours    float64
+	RawHours float64
+	Cost     float64
+}
+
+// validateOrdering checks the sort key, order and grouping of invoice options
+func (opts InvoiceOptions) validateOrdering() error {
+	if opts.SortBy != "" && !slices.Contains(sortKeys, opts.SortBy) {
+		return fmt.Errorf("sort must be one of %s, got %q", strings.Join(sortKeys, ", "), opts.SortBy)
+	}
+	if opts.Order != "" && opts.Order != OrderAsc && opts.Order != OrderDesc {
+		return fmt.Errorf("order must be %s or %s, got %q", OrderAsc, OrderDesc, opts.Order)
+	}
+	switch opts.GroupBy {
+	case "", GroupByRole:
+		return nil
+	case "project":
+		return fmt.Errorf("invoices cover a single project, the company billed, so they can only be grouped by %s", GroupByRole)
+	default:
+		return fmt.Errorf("group must be %s, got %q", GroupByRole, opts.GroupBy)
+	}
+}
+
+// sectionName is the section an employee is listed under, empty when the invoice is not grouped
+func sectionName(opts InvoiceOptions, staff StaffMember) string {
+	if opts.GroupBy != GroupByRole {
+		return ""
+	}
+	if staff.Role == "" {
+		return noRole
+	}
+	return staff.Role
+}
+
+// sortEmployees returns the IDs of the employees in the order they are invoiced:
+// by section when grouped, then by the sort key, then by ID
+func sortEmployees(employees EmployeeMap, directory map[int]StaffMember, opts InvoiceOptions) []int {
+	ids := make([]int, 0, len(employees))
+	for id := range employees {
+		ids = append(ids, id)
+	}
+
+	descending := opts.SortBy == SortByHours || opts.SortBy == SortByCost
+	if opts.Order != "" {
+		descending = opts.Order == OrderDesc
+	}
+
+	slices.SortFunc(ids, func(a, b int) int {
+		if c := compareSections(sectionName(opts, directory[a]), sectionName(opts, directory[b])); c != 0 {
+			return c
+		}
+
+		var c int
+		switch opts.SortBy {
+		case SortByName:
+			c = cmp.Compare(strings.ToLower(employeeLabel(a, directory[a].Name)), strings.ToLower(employeeLabel(b, directory[b].Name)))
+		case SortByHours:
+			c = cmp.Compare(employees[a].TotalHours, employees[b].TotalHours)
+		case SortByCost:
+			c = cmp.Compare(lineCost(employees[a]), lineCost(employees[b]))
+		default:
+			c = cmp.Compare(a, b)
+		}
+		if descending {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a, b))
+	})
+	return ids
+}
+
+// compareSections orders sections by name, case-insensitively, with noRole last
+func compareSections(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == noRole:
+		return 1
+	case b == noRole:
+		return -1
+	}
+	return cmp.Or(cmp.Compare(strings.ToLower(a), strings.ToLower(b)), cmp.Compare(a, b))
+}
+
+// invoiceSections totals the employee groups of an invoice by section, in order.
+// It is empty when the invoice is not grouped.
+func invoiceSections(groups []EntryGroup) []InvoiceSection {
+	var sections []InvoiceSection
+	for _, g := range groups {
+		if g.Section == "" {
+			continue
+		}
+		if len(sections) == 0 || sections[len(sections)-1].Name != g.Section {
+			sections = append(sections, InvoiceSection{Name: g.Section})
+		}
+		s := &sections[len(sections)-1]
+		s.Hours += g.Hours
+		s.RawHours += g.RawHours
+		s.Cost = fromCents(toCents(s.Cost) + toCents(g.Cost))
+	}
+	return sections
+}
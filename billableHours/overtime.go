@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// overtime:
+// - each company may have an overtime policy in its billing settings; without one, every hour is regular
+// - premiums are worked out per employee on billed hours (after rounding), in shift order
+// - weekend: every hour on a Saturday or Sunday work date is billed at the weekend multiplier,
+//   and does not count towards the daily or weekly thresholds
+// - daily: hours beyond the daily threshold on a work date are billed at the daily multiplier
+// - weekly: regular hours beyond the weekly threshold in an ISO week (Monday to Sunday) are billed
+//   at the weekly multiplier; hours already paid as daily overtime are not counted twice
+// - premium hours become their own invoice lines, next to the regular hours at the same rate
+// - an invoice for a period that covers part of a week counts the rest of the week towards the
+//   thresholds, and bills only its own entries' share; a batch only counts its own entries, so a
+//   batch invoice matches its upload summary (see billStoredEntries)
+
+// premium kinds
+const (
+	PremiumDaily   = "daily"
+	PremiumWeekly  = "weekly"
+	PremiumWeekend = "weekend"
+)
+
+// OvertimePolicy bills hours beyond the thresholds, and weekend hours, at a multiple of the
+// billable rate. Thresholds are in hours; a zero threshold or weekend multiplier disables the rule.
+type OvertimePolicy struct {
+	DailyThreshold    float64
+	DailyMultiplier   float64
+	WeeklyThreshold   float64
+	WeeklyMultiplier  float64
+	WeekendMultiplier float64
+}
+
+// PremiumHours are billed hours charged at a multiple of the entry's rate
+type PremiumHours struct {
+	Kind       string
+	Multiplier float64
+	Hours      float64
+}
+
+// validate checks an overtime policy before it is stored
+func (p OvertimePolicy) validate() error {
+	if p.DailyThreshold < 0 || p.WeeklyThreshold < 0 {
+		return fmt.Errorf("overtime thresholds must not be negative")
+	}
+	if p.DailyThreshold > 0 && p.DailyMultiplier <= 0 {
+		return fmt.Errorf("daily overtime multiplier must be positive")
+	}
+	if p.WeeklyThreshold > 0 && p.WeeklyMultiplier <= 0 {
+		return fmt.Errorf("weekly overtime multiplier must be positive")
+	}
+	if p.WeekendMultiplier < 0 {
+		return fmt.Errorf("weekend multiplier must not be negative")
+	}
+	return nil
+}
+
+// premiumLabel describes a premium on an invoice, e.g. "Overtime ×1.5"
+func premiumLabel(kind string, multiplier float64) string {
+	switch kind {
+	case "":
+		return "Regular"
+	case PremiumWeekend:
+		return fmt.Sprintf("Weekend ×%g", multiplier)
+	default:
+		return fmt.Sprintf("Overtime ×%g", multiplier)
+	}
+}
+
+// applyOvertime sets the premium hours of every entry according to the policy.
+// Billed hours must already be set; entries are updated in place and their order is kept.
+func applyOvertime(entries []TimeEntry, policy *OvertimePolicy) {
+	for i := range entries {
+		entries[i].Premiums = nil
+	}
+	if policy == nil {
+		return
+	}
+
+	// each employee's shifts in order
+	type employeeKey struct {
+		company    string
+		employeeID int
+	}
+	byEmployee := make(map[employeeKey][]int)
+	for i, e := range entries {
+		key := employeeKey{e.Company, e.EmployeeID}
+		byEmployee[key] = append(byEmployee[key], i)
+	}
+
+	for _, idx := range byEmployee {
+		sort.SliceStable(idx, func(a, b int) bool { return entries[idx[a]].Start.Before(entries[idx[b]].Start) })
+
+		daily := make(map[string]float64)
+		weekly := make(map[[2]int]float64)
+		for _, i := range idx {
+			e := &entries[i]
+			hours := e.BilledHours
+
+			weekday := e.Date.Weekday()
+			if policy.WeekendMultiplier > 0 && (weekday == time.Saturday || weekday == time.Sunday) {
+				e.Premiums = append(e.Premiums, PremiumHours{Kind: PremiumWeekend, Multiplier: policy.WeekendMultiplier, Hours: hours})
+				continue
+			}
+
+			var dailyOT float64
+			if policy.DailyThreshold > 0 {
+				dailyOT = beyond(daily[e.Date.Format(dateLayout)], hours, policy.DailyThreshold)
+			}
+			daily[e.Date.Format(dateLayout)] += hours
+
+			regular := hours - dailyOT
+			year, week := e.Date.ISOWeek()
+			var weeklyOT float64
+			if policy.WeeklyThreshold > 0 {
+				weeklyOT = beyond(weekly[[2]int{year, week}], regular, policy.WeeklyThreshold)
+			}
+			weekly[[2]int{year, week}] += regular
+
+			if dailyOT > 0 {
+				e.Premiums = append(e.Premiums, PremiumHours{Kind: PremiumDaily, Multiplier: policy.DailyMultiplier, Hours: dailyOT})
+			}
+			if weeklyOT > 0 {
+				e.Premiums = append(e.Premiums, PremiumHours{Kind: PremiumWeekly, Multiplier: policy.WeeklyMultiplier, Hours: weeklyOT})
+			}
+		}
+	}
+}
+
+// entryPortions splits an entry's billed hours into its regular hours (no Kind, a Multiplier of 1)
+// followed by its premiums. Entries without premiums are a single regular portion.
+func entryPortions(e TimeEntry) []PremiumHours {
+	regular := e.BilledHours
+	for _, p := range e.Premiums {
+		regular -= p.Hours
+	}
+	if regular <= 1e-9 && len(e.Premiums) > 0 {
+		return e.Premiums
+	}
+	return append([]PremiumHours{{Multiplier: 1, Hours: max(regular, 0)}}, e.Premiums...)
+}
+
+// rawShare returns the hours worked behind a portion of an entry's billed hours
+func rawShare(e TimeEntry, hours float64) float64 {
+	if e.BilledHours <= 0 {
+		return e.Hours
+	}
+	return e.Hours * hours / e.BilledHours
+}
+
+// beyond returns how many of the hours added to a running total fall past the threshold
+func beyond(before, hours, threshold float64) float64 {
+	return max(0, before+hours-max(before, threshold))
+}
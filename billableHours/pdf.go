@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"codeberg.org/go-pdf/fpdf"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pdfRenderer lays the invoice out as a PDF, branded with the invoice's template.
+// Long tables run over several pages: each page repeats the table header, numbers itself
+// "Page X of Y" and carries the running subtotal forward to the next.
+type pdfRenderer struct{}
+
+// rowHeight is the height of a table row
+const rowHeight = 7.0
+
+func (pdfRenderer) ContentType() string { return "application/pdf" }
+func (pdfRenderer) Extension() string   { return "pdf" }
+
+func (pdfRenderer) Render(w io.Writer, doc InvoiceDocument) error {
+	tpl := doc.template.withDefaults()
+	pdf := fpdf.New("P", "mm", tpl.PaperSize, "")
+	pdf.SetFont(tpl.Font, "", 12)
+	setColor(pdf.SetTextColor, tpl.TextColor)
+
+	// every page ends with its number and the template's footer, so the page breaks above them
+	footer := footerLines(tpl)
+	footerHeight := 4.5 * float64(len(footer)+1)
+	pdf.AliasNbPages("")
+	pdf.SetAutoPageBreak(true, 15+footerHeight)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-(10 + footerHeight))
+		pdf.SetFontStyle("")
+		pdf.SetFontSize(9)
+		for _, line := range footer {
+			pdf.CellFormat(0, 4.5, cp1252(line), "", 1, "C", false, 0, "")
+		}
+		pdf.CellFormat(0, 4.5, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 1, "R", false, 0, "")
+	})
+
+	// continuation pages are headed with the invoice number and company
+	pdf.SetHeaderFunc(func() {
+		if pdf.PageNo() == 1 {
+			return
+		}
+		pdf.SetFontStyle("I")
+		pdf.SetFontSize(10)
+		pdf.Cell(0, 6, cp1252(fmt.Sprintf("Invoice No: %s, %s (continued)", invoiceNumber(doc), doc.CompanyName)))
+		pdf.Ln(10)
+	})
+	pdf.AddPage()
+
+	// logo at the top right, 15mm high
+	if len(tpl.Logo) > 0 {
+		info := pdf.RegisterImageOptionsReader("logo", fpdf.ImageOptions{ImageType: logoType(tpl.Logo)}, bytes.NewReader(tpl.Logo))
+		if info != nil && info.Height() > 0 {
+			width := 15 * info.Width() / info.Height()
+			pageWidth, _ := pdf.GetPageSize()
+			_, _, right, _ := pdf.GetMargins()
+			pdf.ImageOptions("logo", pageWidth-right-width, 10, width, 15, false, fpdf.ImageOptions{}, 0, "")
+		}
+	}
+
+	// file header
+	pdf.SetFontSize(16)
+	pdf.Cell(40, 10, cp1252("Company: "+doc.CompanyName))
+	pdf.Ln(10)
+	pdf.SetFontSize(12)
+	pdf.Cell(95, 7, "Invoice No: "+invoiceNumber(doc))
+	pdf.Cell(95, 7, "Issue Date: "+doc.IssueDate.Format(dateLayout))
+	pdf.Ln(-1)
+	pdf.Cell(95, 7, fmt.Sprintf("Period: %s to %s", doc.PeriodFrom.Format(dateLayout), doc.PeriodTo.Format(dateLayout)))
+	pdf.Cell(95, 7, "Due Date: "+doc.DueDate.Format(dateLayout))
+	pdf.Ln(-1)
+	pdf.Cell(95, 7, cp1252("Currency: "+currencyLabel(doc.Currency)))
+	if po := poNumber(doc); po != "" {
+		pdf.Cell(95, 7, cp1252("PO Number: "+po))
+	}
+	pdf.Ln(-1)
+
+	// bill-to block
+	if lines := billTo(doc); len(lines) > 0 {
+		pdf.Ln(3)
+		pdf.SetFontStyle("B")
+		pdf.Cell(95, 6, "Bill To")
+		pdf.Ln(-1)
+		pdf.SetFontStyle("")
+		for _, line := range lines {
+			pdf.Cell(95, 6, cp1252(line))
+			pdf.Ln(-1)
+		}
+	}
+	pdf.Ln(8)
+
+	table := layoutTable(doc)
+	widths := writeTable(pdf, tpl, table, doc.Currency)
+
+	// the totals block is kept together, so it moves to a new page when it does not fit
+	rows := totalRows(doc.Totals)
+	if !fits(pdf, rowHeight*float64(len(rows))) {
+		breakTable(pdf, tpl, table, widths, formatMoney(doc.Subtotal, doc.Currency))
+	}
+	for _, t := range rows {
+		writeTotalRow(pdf, widths, t.Label, formatMoney(t.Amount, doc.Currency), t.Kind == "total")
+	}
+	if note := unknownNote(doc); note != "" {
+		pdf.Ln(5)
+		pdf.SetFont(tpl.Font, "I", 10)
+		pdf.MultiCell(0, 5, note, "", "", false)
+	}
+
+	return pdf.Output(w)
+}
+
+// footerLines splits a template's footer into lines, dropping blank ones
+func footerLines(tpl InvoiceTemplate) []string {
+	var lines []string
+	for _, line := range strings.Split(tpl.Footer, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// setColor applies a "#RRGGBB" colour with one of the fpdf colour setters
+func setColor(set func(r, g, b int), color string) {
+	r, g, b, err := parseColor(color)
+	if err == nil {
+		set(r, g, b)
+	}
+}
+
+// writeTotalRow writes a labelled amount under the last two table columns.
+// Labels wider than their column spill into the blank cells to their left.
+func writeTotalRow(pdf *fpdf.Fpdf, widths []float64, label string, amount string, bold bool) {
+	pdf.SetFontStyle("")
+	blank := sum(widths[:len(widths)-2])
+	labelWidth := widths[len(widths)-2]
+	if bold {
+		pdf.SetFontStyle("B")
+	}
+	label = cp1252(label)
+	if w := pdf.GetStringWidth(label) + 4; w > labelWidth {
+		shift := max(0, min(w-labelWidth, blank-1))
+		blank -= shift
+		labelWidth += shift
+	}
+
+	if blank > 0 {
+		pdf.CellFormat(blank, rowHeight, "", "TBR", 0, "C", false, 0, "")
+	}
+	pdf.CellFormat(labelWidth, rowHeight, label, "1", 0, "", false, 0, "")
+	pdf.SetFontStyle("")
+	pdf.CellFormat(widths[len(widths)-1], rowHeight, cp1252(amount), "TBL", 0, "R", false, 0, "")
+	pdf.Ln(-1)
+}
+
+// writeTableHeader writes the table header row in the template's accent colour
+func writeTableHeader(pdf *fpdf.Fpdf, tpl InvoiceTemplate, widths []float64, titles []string) {
+	pdf.SetFontStyle("B")
+	setColor(pdf.SetFillColor, tpl.AccentColor)
+	setColor(pdf.SetTextColor, tpl.HeaderTextColor)
+	for i, title := range titles {
+		pdf.CellFormat(widths[i], 10, title, cellBorder(i, len(titles)), 0, "", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFontStyle("")
+	setColor(pdf.SetTextColor, tpl.TextColor)
+}
+
+// cp1252 converts UTF-8 text, such as currency symbols, to the encoding of the core PDF fonts
+var cp1252 = fpdf.New("P", "mm", "A4", "").UnicodeTranslatorFromDescriptor("")
+
+// writeRow writes a single right-aligned table row
+func writeRow(pdf *fpdf.Fpdf, widths []float64, values []string) {
+	for i, value := range values {
+		pdf.CellFormat(widths[i], rowHeight, cp1252(value), cellBorder(i, len(values)), 0, "R", false, 0, "")
+	}
+	pdf.Ln(-1)
+}
+
+// cellBorder returns the border for a table cell; outer cells leave the page edge open
+func cellBorder(i, n int) string {
+	switch i {
+	case 0:
+		return "TBR"
+	case n - 1:
+		return "TBL"
+	default:
+		return "1"
+	}
+}
+
+// columnWidths returns the column widths, scaled down to fit between the margins when they are too wide
+func columnWidths(pdf *fpdf.Fpdf, columns []tableColumn) []float64 {
+	pageWidth, _ := pdf.GetPageSize()
+	left, _, right, _ := pdf.GetMargins()
+	available := pageWidth - left - right
+
+	widths := make([]float64, len(columns))
+	for i, c := range columns {
+		widths[i] = c.Width
+	}
+	if total := sum(widths); total > available {
+		for i := range widths {
+			widths[i] *= available / total
+		}
+	}
+	return widths
+}
+
+// writeTable writes an invoice table, header row first, returning its column widths.
+// Group and section headings span the table and are kept with the row below them; subtotals
+// are in italics, section subtotals in bold. Before a page fills up, the running subtotal is
+// carried forward to the next page.
+func writeTable(pdf *fpdf.Fpdf, tpl InvoiceTemplate, table invoiceTable, currency string) []float64 {
+	widths := columnWidths(pdf, table.Columns)
+	writeTableHeader(pdf, tpl, widths, columnTitles(table))
+
+	// completed holds the summary lines and finished employee groups, group the current group's entries
+	var completed, group float64
+	for i, row := range table.Rows {
+		height := rowHeight
+		for j := i; j+1 < len(table.Rows) && isHeading(table.Rows[j]); j++ {
+			height += rowHeight
+		}
+		// leave room for the carried forward row
+		if !fits(pdf, height+rowHeight) {
+			breakTable(pdf, tpl, table, widths, formatMoney(fromCents(toCents(completed+group)), currency))
+		}
+
+		switch row.Kind {
+		case RowGroup, RowSection:
+			pdf.SetFontStyle("B")
+			pdf.CellFormat(sum(widths), rowHeight, cp1252(row.Cells[0]), "TB", 0, "", false, 0, "")
+			pdf.Ln(-1)
+		case RowSubtotal:
+			pdf.SetFontStyle("I")
+			writeRow(pdf, widths, row.Cells)
+			completed += row.Amount
+			group = 0
+		case RowSectionSubtotal:
+			// the section's employees are already counted
+			pdf.SetFontStyle("B")
+			writeRow(pdf, widths, row.Cells)
+		case RowEntry:
+			writeRow(pdf, widths, row.Cells)
+			group += row.Amount
+		default:
+			writeRow(pdf, widths, row.Cells)
+			completed += row.Amount
+		}
+		pdf.SetFontStyle("")
+	}
+	return widths
+}
+
+// breakTable ends a page with the amount carried forward, and starts the next with the
+// table header and the amount brought forward
+func breakTable(pdf *fpdf.Fpdf, tpl InvoiceTemplate, table invoiceTable, widths []float64, carried string) {
+	writeTotalRow(pdf, widths, "Carried forward", carried, false)
+	pdf.AddPage()
+	writeTableHeader(pdf, tpl, widths, columnTitles(table))
+	writeTotalRow(pdf, widths, "Brought forward", carried, false)
+}
+
+// isHeading reports whether a table row heads the rows below it
+func isHeading(row tableRow) bool {
+	return row.Kind == RowGroup || row.Kind == RowSection
+}
+
+// columnTitles returns the header row of a table
+func columnTitles(table invoiceTable) []string {
+	titles := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		titles[i] = c.Title
+	}
+	return titles
+}
+
+// fits reports whether content of the given height fits on the page above the bottom margin
+func fits(pdf *fpdf.Fpdf, height float64) bool {
+	_, pageHeight := pdf.GetPageSize()
+	_, margin := pdf.GetAutoPageBreak()
+	return pdf.GetY()+height <= pageHeight-margin
+}
+
+// sum adds up a slice of floats
+func sum(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
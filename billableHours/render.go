@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Renderer lays an invoice document out in a single output format
+type Renderer interface {
+	// ContentType is the media type of the rendered invoice
+	ContentType() string
+	// Extension is the file extension of the rendered invoice, without the dot
+	Extension() string
+	Render(w io.Writer, doc InvoiceDocument) error
+}
+
+// renderers maps the format names accepted by download to their renderer
+var renderers = map[string]Renderer{
+	"pdf":  pdfRenderer{},
+	"html": htmlRenderer{},
+	"csv":  csvRenderer{},
+	"json": jsonRenderer{},
+	"ubl":  ublRenderer{},
+}
+
+// formatAliases are alternative names for formats
+var formatAliases = map[string]string{
+	"htm": "html",
+	"xml": "ubl",
+}
+
+// acceptFormats maps media types in an Accept header to format names
+var acceptFormats = map[string]string{
+	"application/pdf":  "pdf",
+	"text/html":        "html",
+	"text/csv":         "csv",
+	"application/json": "json",
+	"application/xml":  "ubl",
+	"text/xml":         "ubl",
+}
+
+// formatName resolves a format name or alias, reporting whether it is supported
+func formatName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := formatAliases[name]; ok {
+		name = alias
+	}
+	_, ok := renderers[name]
+	return name, ok
+}
+
+// negotiateFormat picks the format for an Accept header: the supported media type
+// with the highest quality, earlier types winning ties. Wildcards and an empty
+// header mean PDF, and so does a browser's navigation header (text/html next to a
+// wildcard, without an explicit PDF), so a download link still gives a PDF;
+// it reports false when nothing acceptable is supported.
+func negotiateFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "pdf", true
+	}
+
+	best, bestQ := "", 0.0
+	html, wildcard, pdf := false, false, false
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		format, ok := acceptFormats[mediaType]
+		if mediaType == "*/*" || mediaType == "application/*" {
+			format, ok = "pdf", true
+			wildcard = wildcard || q > 0
+		} else if ok {
+			html = html || format == "html" && q > 0
+			pdf = pdf || format == "pdf"
+		}
+		if ok && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if html && wildcard && !pdf {
+		return "pdf", true
+	}
+	return best, best != ""
+}
+
+// totalRow is a labelled amount in an invoice's totals block
+type totalRow struct {
+	Kind   string
+	Label  string
+	Amount float64
+}
+
+// totalRows lists the totals block: subtotal, discount and taxes only when there are any,
+// then the total
+func totalRows(t Totals) []totalRow {
+	var rows []totalRow
+	if t.Discount != 0 || len(t.Taxes) > 0 {
+		rows = append(rows, totalRow{Kind: "subtotal", Label: "Subtotal", Amount: t.Subtotal})
+		if t.DiscountLabel != "" {
+			rows = append(rows, totalRow{Kind: "discount", Label: t.DiscountLabel, Amount: -t.Discount})
+		}
+		for _, tax := range t.Taxes {
+			rows = append(rows, totalRow{Kind: "tax", Label: fmt.Sprintf("%s (%g%%)", tax.Name, tax.Rate), Amount: tax.Amount})
+		}
+	}
+	return append(rows, totalRow{Kind: "total", Label: "Total (" + t.Currency + ")", Amount: t.Total})
+}
+
+// invoiceNumber is the number printed on an invoice
+func invoiceNumber(doc InvoiceDocument) string {
+	if doc.Draft {
+		return "DRAFT"
+	}
+	return doc.Number
+}
+
+// billTo lists the lines of an invoice's bill-to block: the client's legal name, address,
+// tax ID and contact email. It is empty for companies without a client record.
+func billTo(doc InvoiceDocument) []string {
+	if doc.Client == nil {
+		return nil
+	}
+	lines := append([]string{doc.Client.DisplayName()}, doc.Client.AddressLines()...)
+	if doc.Client.TaxID != "" {
+		lines = append(lines, "Tax ID: "+doc.Client.TaxID)
+	}
+	if doc.Client.Email != "" {
+		lines = append(lines, doc.Client.Email)
+	}
+	return lines
+}
+
+// poNumber is the purchase order number quoted on an invoice, if any
+func poNumber(doc InvoiceDocument) string {
+	if doc.Client == nil {
+		return ""
+	}
+	return doc.Client.PONumber
+}
+
+// unknownMark flags employees missing from the employee directory, see unknownNote
+const unknownMark = " *"
+
+// employeeCell names an employee in a table: the directory name, or the ID flagged as unknown
+func employeeCell(id int, name string) string {
+	if name == "" {
+		return employeeLabel(id, name) + unknownMark
+	}
+	return name
+}
+
+// employeeHeading names an employee above their itemised entries, with their role and ID
+func employeeHeading(g EntryGroup) string {
+	switch {
+	case g.EmployeeName == "":
+		return employeeCell(g.EmployeeID, "")
+	case g.EmployeeRole == "":
+		return fmt.Sprintf("%s (ID %d)", g.EmployeeName, g.EmployeeID)
+	default:
+		return fmt.Sprintf("%s, %s (ID %d)", g.EmployeeName, g.EmployeeRole, g.EmployeeID)
+	}
+}
+
+// unknownNote is the footnote explaining unknownMark, empty when every employee is in the directory
+func unknownNote(doc InvoiceDocument) string {
+	if len(doc.UnknownEmployees) == 0 {
+		return ""
+	}
+	ids := make([]string, len(doc.UnknownEmployees))
+	for i, id := range doc.UnknownEmployees {
+		ids[i] = strconv.Itoa(id)
+	}
+	return "* Not in the employee directory: employee ID " + strings.Join(ids, ", ")
+}
+
+// hasRoles reports whether any invoice line names the employee's role
+func hasRoles(doc InvoiceDocument) bool {
+	for _, line := range doc.Lines {
+		if line.EmployeeRole != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonRenderer writes the invoice document as JSON, for importing into other systems
+type jsonRenderer struct{}
+
+func (jsonRenderer) ContentType() string { return "application/json" }
+func (jsonRenderer) Extension() string   { return "json" }
+
+func (jsonRenderer) Render(w io.Writer, doc InvoiceDocument) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// csvRenderer writes one row per invoice line, or per time entry when itemised,
+// followed by the totals block. Amounts are plain numbers in the invoice currency.
+type csvRenderer struct{}
+
+func (csvRenderer) ContentType() string { return "text/csv" }
+func (csvRenderer) Extension() string   { return "csv" }
+
+func (csvRenderer) Render(w io.Writer, doc InvoiceDocument) error {
+	writer := csv.NewWriter(w)
+	number := invoiceNumber(doc)
+	money := func(amount float64) string { return strconv.FormatFloat(amount, 'f', 2, 64) }
+
+	rows := [][]string{{"Invoice Number", "Type", "Description", "Employee ID", "Employee Name", "Role", "Date", "Start", "End", "Worked Hours", "Billed Hours", "Rate Type", "Multiplier", "Rate", "Rate Currency", "Amount", "Currency"}}
+	if doc.Itemised {
+		for _, g := range doc.Groups {
+			for _, e := range g.Entries {
+				rows = append(rows, []string{
+					number, "entry", "", strconv.Itoa(g.EmployeeID), g.EmployeeName, g.EmployeeRole,
+					e.Date.Format(dateLayout), e.Start.Format(clockLayout), e.End.Format(clockLayout),
+					money(e.RawHours), money(e.Hours), e.Type, strconv.FormatFloat(e.Multiplier, 'f', -1, 64), money(e.Rate), e.RateCurrency, money(e.Cost), doc.Currency,
+				})
+			}
+		}
+	} else {
+		for _, line := range doc.Lines {
+			rows = append(rows, []string{
+				number, "line", "", strconv.Itoa(line.EmployeeID), line.EmployeeName, line.EmployeeRole, "", "", "",
+				money(line.RawHours), money(line.Hours), line.Type, strconv.FormatFloat(line.Multiplier, 'f', -1, 64), money(line.Rate), line.RateCurrency, money(line.Cost), doc.Currency,
+			})
+		}
+	}
+	for _, t := range totalRows(doc.Totals) {
+		rows = append(rows, []string{number, t.Kind, t.Label, "", "", "", "", "", "", "", "", "", "", "", "", money(t.Amount), doc.Currency})
+	}
+
+	return writer.WriteAll(rows)
+}
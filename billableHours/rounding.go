@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// time rounding:
+// - each company may have a rounding policy in its billing settings; without one, time is billed exactly
+// - entries keep the hours worked (Hours) and get the hours billed (BilledHours) before they are rolled up
+// - each entry is rounded to a multiple of the increment (up, down or to the nearest), in whole seconds
+// - then raised to the per-entry minimum
+// - then, per employee and work date, the shortfall against the per-day minimum is added to the day's last entry
+
+// rounding directions
+const (
+	RoundUp      = "up"
+	RoundDown    = "down"
+	RoundNearest = "nearest"
+)
+
+// RoundingPolicy adjusts the time billed for each entry. Durations are in minutes;
+// zero disables a rule.
+type RoundingPolicy struct {
+	Increment    int
+	Direction    string
+	MinimumEntry int
+	MinimumDay   int
+}
+
+// validate checks a rounding policy before it is stored
+func (p RoundingPolicy) validate() error {
+	if p.Increment < 0 || p.MinimumEntry < 0 || p.MinimumDay < 0 {
+		return fmt.Errorf("rounding increment and minimums must not be negative")
+	}
+	if p.Increment > 0 {
+		switch p.Direction {
+		case RoundUp, RoundDown, RoundNearest:
+		default:
+			return fmt.Errorf("rounding direction must be %s, %s or %s, got %q", RoundUp, RoundDown, RoundNearest, p.Direction)
+		}
+	}
+	return nil
+}
+
+// roundSeconds rounds a duration in seconds to a multiple of the policy's increment
+func (p RoundingPolicy) roundSeconds(secs int64) int64 {
+	inc := int64(p.Increment) * 60
+	if inc <= 0 {
+		return secs
+	}
+	switch p.Direction {
+	case RoundUp:
+		return (secs + inc - 1) / inc * inc
+	case RoundDown:
+		return secs / inc * inc
+	default:
+		return (secs + inc/2) / inc * inc
+	}
+}
+
+// applyRounding sets the billed hours of every entry according to the policy.
+// Entries are updated in place; their order is kept.
+func applyRounding(entries []TimeEntry, policy *RoundingPolicy) {
+	if policy == nil {
+		for i := range entries {
+			entries[i].BilledHours = entries[i].Hours
+		}
+		return
+	}
+
+	minEntry := int64(policy.MinimumEntry) * 60
+	for i, e := range entries {
+		secs := policy.roundSeconds(int64(math.Round(e.Hours * 3600)))
+		entries[i].BilledHours = float64(max(secs, minEntry)) / 3600
+	}
+
+	if policy.MinimumDay <= 0 {
+		return
+	}
+
+	// per-day minimum: top up each employee's day on its last entry
+	type day struct {
+		company    string
+		employeeID int
+		date       string
+	}
+	byDay := make(map[day][]int)
+	var days []day
+	for i, e := range entries {
+		d := day{e.Company, e.EmployeeID, e.Date.Format(dateLayout)}
+		if _, exists := byDay[d]; !exists {
+			days = append(days, d)
+		}
+		byDay[d] = append(byDay[d], i)
+	}
+
+	minDay := float64(policy.MinimumDay) / 60
+	for _, d := range days {
+		idx := byDay[d]
+		sort.SliceStable(idx, func(a, b int) bool { return entries[idx[a]].Start.Before(entries[idx[b]].Start) })
+
+		var billed float64
+		for _, i := range idx {
+			billed += entries[i].BilledHours
+		}
+		if short := minDay - billed; short > 1e-9 {
+			entries[idx[len(idx)-1]].BilledHours += short
+		}
+	}
+}
@@ -14,7 +14,40 @@ func Router() *mux.Router {
 
 	// register route
 	router.HandleFunc("/upload", upload).Methods("POST")
+	router.HandleFunc("/download", exportInvoices).Methods("GET")
 	router.HandleFunc("/download/{companyName}", download).Methods("GET")
+	router.HandleFunc("/batches", batches).Methods("GET")
+	router.HandleFunc("/batches/{id}", batch).Methods("GET")
+	router.HandleFunc("/batches/{id}/download", exportInvoices).Methods("GET")
+	router.HandleFunc("/batches/{id}/download/{companyName}", download).Methods("GET")
+	router.HandleFunc("/clients", clients).Methods("GET")
+	router.HandleFunc("/clients", upsertClient).Methods("POST")
+	router.HandleFunc("/clients/{id}", client).Methods("GET")
+	router.HandleFunc("/clients/{id}", upsertClient).Methods("PUT")
+	router.HandleFunc("/clients/{id}", removeClient).Methods("DELETE")
+	router.HandleFunc("/companies/{companyName}/billing", billingSettings).Methods("GET")
+	router.HandleFunc("/companies/{companyName}/billing", updateBillingSettings).Methods("PUT")
+	router.HandleFunc("/employees", employees).Methods("GET")
+	router.HandleFunc("/employees", updateEmployees).Methods("PUT")
+	router.HandleFunc("/employees/upload", uploadEmployees).Methods("POST")
+	router.HandleFunc("/employees/{id}", employee).Methods("GET")
+	router.HandleFunc("/employees/{id}", upsertEmployee).Methods("PUT")
+	router.HandleFunc("/employees/{id}", removeEmployee).Methods("DELETE")
+	router.HandleFunc("/exchange-rates", exchangeRates).Methods("GET")
+	router.HandleFunc("/exchange-rates", updateExchangeRates).Methods("PUT")
+	router.HandleFunc("/exchange-rates/upload", uploadExchangeRates).Methods("POST")
+	router.HandleFunc("/invoices", invoices).Methods("GET")
+	router.HandleFunc("/invoices/{number}", invoice).Methods("GET")
+	router.HandleFunc("/templates", invoiceTemplates).Methods("GET")
+	router.HandleFunc("/templates/{name}", invoiceTemplate).Methods("GET")
+	router.HandleFunc("/templates/{name}", upsertTemplate).Methods("PUT")
+	router.HandleFunc("/templates/{name}", removeTemplate).Methods("DELETE")
+	router.HandleFunc("/templates/{name}/logo", uploadTemplateLogo).Methods("POST")
+	router.HandleFunc("/profiles", profiles).Methods("GET")
+	router.HandleFunc("/profiles", upsertProfile).Methods("POST")
+	router.HandleFunc("/profiles/{name}", profile).Methods("GET")
+	router.HandleFunc("/profiles/{name}", upsertProfile).Methods("PUT")
+	router.HandleFunc("/profiles/{name}", removeProfile).Methods("DELETE")
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodOptions {
@@ -33,6 +66,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, X-Invoice-Number")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -1,179 +1,1166 @@
 package main
 
 import (
-	"codeberg.org/go-pdf/fpdf"
+	"database/sql"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"io"
+	"math"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// company map: key: companyName, value: employee-map
-// employee map: key employee id, value: {billableRate, totalHours}
+// storage:
+// - batches table: one row per upload (id, filename, entry count, creation date)
+// - time_entries table: one row per timesheet line (batch, employee, rate, company, date, start, end, hours)
+//	- start and end are full datetimes, so shifts crossing midnight keep their real duration
+// - company_employees view: hours worked rolled up per batch + company + employee + rate + currency
+// - invoices roll entries up in rollup, once the company's billing rules have set their billed hours
 //
 // insertion:
-// - loop through csv file
-// - update map with entry:
-//	- if company exists
-//		- if employee has worked for company
-//			- update employee hours
-//		- else:
-//			- add employee details
-//	- else:
-//		- add company and employee details
+// - find columns by header name (aliases, or an explicit mapping / import profile)
+// - loop through the rows of a csv file in its dialect (see dialect.go), or of an excel sheet (see xlsx.go)
+// - parse each line into a time entry, collecting every problem (line, column, reason)
+// - strict: reject the upload if any line is invalid; lenient: drop invalid lines; validate: store nothing
+// - create a batch and save all entries under it in a single transaction
+// - return the batch and its entries rolled up as a company map
 //
 // retrieval
-// - access map by company name
-// - loop though employees
-// - update output pdf with employee data
-// - return
+// - load the company's entries, optionally scoped to a batch
+// - apply the company's rounding (see rounding.go) and overtime (see overtime.go) policies
+// - roll entries up per employee and rate, billing the rounded hours with premium hours on their own lines
+// - build the invoice model (see invoice.go) and hand it to a renderer
 
-// CompanyMap is a global map holding all companies and their employees
+// CompanyMap is a map holding companies and their employees
 type CompanyMap map[string]EmployeeMap
 
 // EmployeeMap holds employee details
 type EmployeeMap map[int]Employee
 
-// Employee represents an employee
+// Employee represents an employee's billed time, split by billable rate.
+// TotalHours are the hours billed, RawHours the hours worked.
 type Employee struct {
+	TotalHours float64
+	RawHours   float64
+	TotalCost  float64
+	Rates      []RateLine
+}
+
+// RateLine holds the hours an employee billed at a single billable rate, either
+// regular or at a premium (an empty Premium is regular, with a Multiplier of 1).
+// An empty currency is the company's billing currency.
+type RateLine struct {
 	BillableRate float64
-	TotalHours   float64
+	Currency     string
+	Premium      string
+	Multiplier   float64
+	Hours        float64
+	RawHours     float64
+	Cost         float64
 }
 
-var companyMap CompanyMap
+// TimeEntry represents a single line of an uploaded timesheet
+type TimeEntry struct {
+	// ID is the stored entry's row ID, zero until it is stored
+	ID           int64
+	EmployeeID   int
+	BillableRate float64
+	Currency     string
+	Company      string
+	Date         time.Time
+	Start        time.Time
+	End          time.Time
+	Hours        float64
+	// BilledHours are the hours charged after the company's rounding policy,
+	// of which Premiums are charged at a multiple of the rate (see overtime.go)
+	BilledHours float64
+	Premiums    []PremiumHours
+}
 
-// readCSV reads and processes the CSV file provided
-func readCSV(reader io.Reader) (CompanyMap, error) {
-	cm := make(CompanyMap)
-	csvReader := csv.NewReader(reader)
-	csvReader.TrimLeadingSpace = true
-	csvReader.FieldsPerRecord = -1
-	layout := "15:04"
+// Batch represents a single timesheet upload
+type Batch struct {
+	ID         string
+	Filename   string
+	EntryCount int
+	CreatedAt  time.Time
+}
+
+// UploadResult is returned after an upload: the batch created and its data.
+// Ambiguous lists the dates that could be read either way (see dates.go), and Duplicates
+// the rows skipped as already uploaded (see duplicates.go);
+// Dialect is how a CSV file was read, nil for Excel workbooks.
+type UploadResult struct {
+	Batch
+	Companies  CompanyMap
+	Warnings   []string
+	Rejected   []RowError
+	Ambiguous  []RowError
+	Duplicates []RowError
+	Dialect    *CSVDialect
+}
+
+// EntryFilter selects which stored time entries to load.
+// From and To are inclusive work dates; a zero value leaves that side open.
+// Aliases are former names of the company, whose entries are loaded as the company's.
+type EntryFilter struct {
+	BatchID string
+	Company string
+	Aliases []string
+	From    time.Time
+	To      time.Time
+}
+
+// dateLayout is the format used for work dates in query parameters and on invoices
+const dateLayout = "2006-01-02"
+
+// timesheet columns, identified by header name rather than position
+const (
+	colEmployeeID   = "employee_id"
+	colBillableRate = "billable_rate"
+	colProject      = "project"
+	colDate         = "date"
+	colStartTime    = "start_time"
+	colEndTime      = "end_time"
+	colCurrency     = "currency"
+)
+
+// requiredColumns lists every column a timesheet must have, in the documented order
+var requiredColumns = []string{colEmployeeID, colBillableRate, colProject, colDate, colStartTime, colEndTime}
+
+// optionalColumns are read when present
+var optionalColumns = []string{colCurrency}
+
+// columnAliases are the header names recognised for each column, compared after normalizeHeader
+var columnAliases = map[string][]string{
+	colEmployeeID:   {"employee id", "employee", "emp id", "employee no", "employee number", "id"},
+	colBillableRate: {"billable rate (per hour)", "billable rate", "rate", "hourly rate", "rate per hour"},
+	colProject:      {"project", "company", "client", "company name"},
+	colDate:         {"date", "work date", "day"},
+	colStartTime:    {"start time", "start", "time in", "from"},
+	colEndTime:      {"end time", "end", "time out", "to"},
+	colCurrency:     {"currency", "rate currency", "ccy"},
+}
+
+// ColumnMapping maps a timesheet column (e.g. "start_time") to the header name used in a file
+type ColumnMapping map[string]string
 
-	// skip header
-	if _, err := csvReader.Read(); err != nil {
-		return nil, fmt.Errorf("failed to read header: %w", err)
+// ImportProfile is a named, stored column mapping that can be reused across uploads
+type ImportProfile struct {
+	Name      string
+	Mapping   ColumnMapping
+	CreatedAt time.Time
+}
+
+// UploadOptions controls how an uploaded timesheet is read
+type UploadOptions struct {
+	// Mapping overrides header lookup for the columns it names
+	Mapping ColumnMapping
+	// Mode is one of ModeStrict (default), ModeLenient, ModeValidate or ModeMerge
+	Mode string
+	// Sheet picks the worksheet of an Excel upload by name or 1-based index; empty means the first
+	Sheet string
+	// Dialect overrides the detected encoding, delimiter and quoting of a CSV upload
+	Dialect CSVDialect
+	// Locale sets the order of day and month in the upload's dates, LocaleUS or LocaleEU (see dates.go)
+	Locale string
+}
+
+// validate checks that a mapping only names known columns
+func (m ColumnMapping) validate() error {
+	for col := range m {
+		if _, known := columnAliases[col]; !known {
+			known := append(append([]string{}, requiredColumns...), optionalColumns...)
+			return fmt.Errorf("unknown column %q in mapping, expected one of: %s", col, strings.Join(known, ", "))
+		}
 	}
+	return nil
+}
+
+// normalizeHeader lowercases a header name and collapses separators so aliases match loosely
+func normalizeHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.NewReplacer("_", " ", "-", " ", ".", " ").Replace(name)
+	return strings.Join(strings.Fields(name), " ")
+}
 
-	// read lines
+// resolveColumns finds the position of every required column in the header row.
+// Columns named in the mapping are looked up by that header name; the rest by alias.
+func resolveColumns(header []string, mapping ColumnMapping) (map[string]int, error) {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		n := normalizeHeader(name)
+		if _, exists := positions[n]; !exists {
+			positions[n] = i
+		}
+	}
+
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(requiredColumns))
+	var missing []string
+	for _, col := range append(append([]string{}, requiredColumns...), optionalColumns...) {
+		if name, mapped := mapping[col]; mapped {
+			i, exists := positions[normalizeHeader(name)]
+			if !exists {
+				return nil, fmt.Errorf("column %q mapped to %s was not found in the header", name, col)
+			}
+			columns[col] = i
+			continue
+		}
+
+		found := false
+		for _, alias := range columnAliases[col] {
+			if i, exists := positions[alias]; exists {
+				columns[col] = i
+				found = true
+				break
+			}
+		}
+		if !found && !slices.Contains(optionalColumns, col) {
+			missing = append(missing, col)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required columns: %s (header was: %s)", strings.Join(missing, ", "), strings.Join(header, ", "))
+	}
+	return columns, nil
+}
+
+// upload modes
+const (
+	// ModeStrict rejects the whole upload when any row is invalid
+	ModeStrict = "strict"
+	// ModeLenient imports the valid rows and reports the rejected ones
+	ModeLenient = "lenient"
+	// ModeValidate only reports problems, nothing is imported
+	ModeValidate = "validate"
+	// ModeMerge checks rows like ModeStrict, then imports only those not already uploaded (see duplicates.go)
+	ModeMerge = "merge"
+)
+
+// RowError describes a single problem found in an uploaded file
+type RowError struct {
+	Line   int
+	Column string
+	Value  string
+	Reason string
+}
+
+// ValidationError is returned when an upload is rejected, carrying every problem found
+type ValidationError struct {
+	Errors []RowError
+}
+
+func (e *ValidationError) Error() string {
+	first := e.Errors[0]
+	msg := fmt.Sprintf("line %d: %s", first.Line, first.Reason)
+	if first.Column != "" {
+		msg = fmt.Sprintf("line %d: %s %q: %s", first.Line, first.Column, first.Value, first.Reason)
+	}
+	if len(e.Errors) > 1 {
+		msg += fmt.Sprintf(" (and %d more problems)", len(e.Errors)-1)
+	}
+	return msg
+}
+
+// readCSV reads and processes the CSV file provided, in its detected or given dialect
+// (see dialect.go), storing it as a new batch (see importRows)
+func readCSV(reader io.Reader, filename string, opts UploadOptions) (UploadResult, error) {
+	src, err := openCSV(reader, opts.Dialect)
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	header, _, err := src.Read()
+	if err != nil {
+		return UploadResult{}, fmt.Errorf("failed to read header: %w", err)
+	}
+	// rows are read in the dialect detected, which decides how numbers are written
+	opts.Dialect = src.dialect
+	res, err := importRows(header, src.Read, filename, opts)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	res.Dialect = &src.dialect
+	return res, nil
+}
+
+// importRows processes the rows of an uploaded timesheet, read one at a time by next
+// with their line numbers until io.EOF, and stores them as a new batch. Every row is
+// checked before anything is stored; how invalid rows are handled depends on the upload mode.
+// A merge skips and reports the rows already uploaded.
+func importRows(header []string, next func() ([]string, int, error), filename string, opts UploadOptions) (UploadResult, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = ModeStrict
+	}
+	if mode != ModeStrict && mode != ModeLenient && mode != ModeValidate && mode != ModeMerge {
+		return UploadResult{}, fmt.Errorf("unknown upload mode %q, expected strict, lenient, validate or merge", mode)
+	}
+
+	// locate columns by header name
+	columns, err := resolveColumns(header, opts.Mapping)
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	// read every row first, so ambiguous dates can be read in the order the rest of the file uses
+	type row struct {
+		record []string
+		line   int
+	}
+	var rows []row
+	var dateValues []string
+	rejected := []RowError{}
 	for {
-		record, err := csvReader.Read()
+		record, line, err := next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+
+			// malformed lines are reported like any other invalid row
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rejected = append(rejected, RowError{Line: parseErr.Line, Reason: parseErr.Err.Error()})
+				continue
+			}
+			return UploadResult{}, err
 		}
+		rows = append(rows, row{record, line})
+		if i := columns[colDate]; i < len(record) {
+			dateValues = append(dateValues, record[i])
+		}
+	}
 
-		if len(record) < 6 {
-			return nil, fmt.Errorf("invalid record: expected >=6 fields, got %d", len(record))
+	locales, err := clientLocales()
+	if err != nil {
+		return UploadResult{}, err
+	}
+	dates := newDateReader(opts.Locale, locales, dateValues)
+
+	var entries []TimeEntry
+	var lines []int
+	for _, r := range rows {
+		entry, problems := parseRecord(r.record, columns, r.line, dates, opts.Dialect)
+		if len(problems) > 0 {
+			rejected = append(rejected, problems...)
+			continue
 		}
+		entries = append(entries, entry)
+		lines = append(lines, r.line)
+	}
+	slices.SortStableFunc(rejected, func(a, b RowError) int { return a.Line - b.Line })
 
-		id, rate, companyName, _, startTime, endTime := record[0], record[1], record[2], record[3], record[4], record[5]
+	if len(rejected) > 0 && (mode == ModeStrict || mode == ModeMerge || len(entries) == 0 && mode == ModeLenient) {
+		return UploadResult{}, &ValidationError{Errors: rejected}
+	}
 
-		// format data from file
-		eid, err := strconv.Atoi(strings.TrimSpace(id))
+	var batch Batch
+	var duplicates []RowError
+	if mode == ModeMerge {
+		batch, entries, duplicates, err = mergeBatch(filename, entries, lines)
 		if err != nil {
-			return nil, fmt.Errorf("invalid employee id %q: %w", id, err)
+			return UploadResult{}, err
+		}
+	}
+
+	// the summary bills time under each company's current rounding and overtime policies
+	if err := applyBillingRules(entries); err != nil {
+		return UploadResult{}, err
+	}
+	cm := rollup(entries)
+	res := UploadResult{Batch: batch, Companies: cm, Warnings: rateWarnings(cm), Rejected: rejected, Ambiguous: dates.Ambiguous, Duplicates: duplicates}
+	if mode == ModeValidate || mode == ModeMerge {
+		return res, nil
+	}
+
+	res.Batch, err = saveBatch(filename, entries)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	return res, nil
+}
+
+// parseRecord turns a single CSV record into a time entry, collecting every problem with it.
+// A date read without knowing its order is reported to dates once the row is known to be valid;
+// numbers are read as the dialect writes them.
+func parseRecord(record []string, columns map[string]int, line int, dates *dateReader, dialect CSVDialect) (TimeEntry, []RowError) {
+	var problems []RowError
+	field := func(col string) string {
+		if columns[col] >= len(record) {
+			problems = append(problems, RowError{Line: line, Column: col, Reason: "missing value"})
+			return ""
+		}
+		return strings.TrimSpace(record[columns[col]])
+	}
+	reject := func(col, value, reason string) {
+		problems = append(problems, RowError{Line: line, Column: col, Value: value, Reason: reason})
+	}
+
+	id, rate, companyName := field(colEmployeeID), field(colBillableRate), field(colProject)
+	date, startTime, endTime := field(colDate), field(colStartTime), field(colEndTime)
+	if len(problems) > 0 {
+		return TimeEntry{}, problems
+	}
+
+	// format data from file
+	eid, err := strconv.Atoi(id)
+	if err != nil {
+		reject(colEmployeeID, id, "invalid employee id")
+	}
+
+	bRate, err := dialect.parseNumber(rate)
+	if err != nil {
+		reject(colBillableRate, rate, "invalid billable rate")
+	} else if bRate < 0 {
+		reject(colBillableRate, rate, "billable rate must not be negative")
+	}
+
+	cName := strings.ToLower(companyName)
+	if cName == "" {
+		reject(colProject, companyName, "project is required")
+	}
+
+	// the rate's currency, when the file has one
+	var currency string
+	if i, exists := columns[colCurrency]; exists && i < len(record) {
+		currency = normalizeCurrency(record[i])
+		if currency != "" && !isCurrencyCode(currency) {
+			reject(colCurrency, record[i], "invalid currency code, expected e.g. USD")
 		}
+	}
 
-		bRate, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	workDate, otherDate, dateErr := dates.parse(date, cName)
+	if dateErr != nil {
+		reject(colDate, date, "invalid date: "+dateErr.Error())
+	}
+
+	// clock times need a valid date to be placed on
+	var start, end time.Time
+	if dateErr == nil || !isClock(startTime) {
+		start, err = parseClock(workDate, startTime)
 		if err != nil {
-			return nil, fmt.Errorf("invalid billable rate %q: %w", rate, err)
+			reject(colStartTime, startTime, "invalid start time: "+err.Error())
+		} else if end, err = parseShiftEnd(start, endTime); err != nil {
+			reject(colEndTime, endTime, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return TimeEntry{}, problems
+	}
+	if !otherDate.IsZero() {
+		dates.Ambiguous = append(dates.Ambiguous, RowError{Line: line, Column: colDate, Value: date, Reason: fmt.Sprintf(
+			"ambiguous date read month first as %s, day first it would be %s; set a locale to choose",
+			workDate.Format(dateLayout), otherDate.Format(dateLayout))})
+	}
+	return TimeEntry{
+		EmployeeID:   eid,
+		BillableRate: bRate,
+		Currency:     currency,
+		Company:      cName,
+		Date:         workDate,
+		Start:        start,
+		End:          end,
+		Hours:        end.Sub(start).Hours(),
+		BilledHours:  end.Sub(start).Hours(),
+	}, nil
+}
+
+// parseShiftEnd resolves the end of a shift that began at start.
+// Times may be clock times ("15:04") or full datetimes ("2006-01-02 15:04").
+// A clock end time earlier than the start is taken to be on the next day,
+// so a 22:00-06:00 shift is 8 hours; shifts that still don't end after they
+// start are rejected.
+func parseShiftEnd(start time.Time, endTime string) (time.Time, error) {
+	// clock end times are on the day the shift started
+	end, err := parseClock(truncateDay(start), endTime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid end time: %w", err)
+	}
+
+	if end.Before(start) && isClock(endTime) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	if !end.After(start) {
+		return time.Time{}, fmt.Errorf("shift must end after it starts (starts %s)", start.Format(dateTimeLayout))
+	}
+	return end, nil
+}
+
+// clockLayout is the format of clock times in uploaded timesheets
+const clockLayout = "15:04"
+
+// dateTimeLayout is the format of full datetimes in uploaded timesheets
+const dateTimeLayout = "2006-01-02 15:04"
+
+// truncateDay returns midnight at the start of t's day
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// rollup groups time entries by company and employee, summing hours and
+// cost per billable rate. Cost is computed per entry at the entry's own rate.
+func rollup(entries []TimeEntry) CompanyMap {
+	cm := make(CompanyMap)
+	for _, e := range entries {
+		company, exists := cm[e.Company]
+		if !exists {
+			company = make(EmployeeMap)
+			cm[e.Company] = company
+		}
+
+		employee := company[e.EmployeeID]
+		employee.TotalHours += e.BilledHours
+		employee.RawHours += e.Hours
+
+		// regular hours, then each premium, with the hours worked shared out in proportion
+		for _, p := range entryPortions(e) {
+			raw := rawShare(e, p.Hours)
+			cost := p.Hours * e.BillableRate * p.Multiplier
+			employee.TotalCost += cost
+
+			// add to the line for this rate and premium, or start a new one
+			found := false
+			for i := range employee.Rates {
+				line := &employee.Rates[i]
+				if line.BillableRate == e.BillableRate && line.Currency == e.Currency && line.Premium == p.Kind && line.Multiplier == p.Multiplier {
+					line.Hours += p.Hours
+					line.RawHours += raw
+					line.Cost += cost
+					found = true
+					break
+				}
+			}
+			if !found {
+				employee.Rates = append(employee.Rates, RateLine{
+					BillableRate: e.BillableRate,
+					Currency:     e.Currency,
+					Premium:      p.Kind,
+					Multiplier:   p.Multiplier,
+					Hours:        p.Hours,
+					RawHours:     raw,
+					Cost:         cost,
+				})
+			}
 		}
 
-		cName := strings.TrimSpace(strings.ToLower(companyName))
+		company[e.EmployeeID] = employee
+	}
+	return cm
+}
 
-		start, err := time.Parse(layout, strings.TrimSpace(startTime))
+// applyBillingRules applies each company's rounding and overtime policies to its entries.
+// Entries under a client's former name follow the client's settings, filed under its current name.
+func applyBillingRules(entries []TimeEntry) error {
+	byCompany := make(map[string][]int)
+	for i, e := range entries {
+		byCompany[e.Company] = append(byCompany[e.Company], i)
+	}
+
+	for company, idx := range byCompany {
+		name, err := currentName(company)
 		if err != nil {
-			return nil, fmt.Errorf("invalid start time %q: %w", startTime, err)
+			return err
 		}
-		end, err := time.Parse(layout, strings.TrimSpace(endTime))
+		settings, err := getBillingSettings(name)
 		if err != nil {
-			return nil, fmt.Errorf("invalid end time %q: %w", endTime, err)
+			return err
 		}
 
-		diff := end.Sub(start).Hours()
+		companyEntries := make([]TimeEntry, len(idx))
+		for j, i := range idx {
+			companyEntries[j] = entries[i]
+		}
+		applyRounding(companyEntries, settings.Rounding)
+		applyOvertime(companyEntries, settings.Overtime)
+		for j, i := range idx {
+			entries[i] = companyEntries[j]
+		}
+	}
+	return nil
+}
+
+// billStoredEntries sets the billed hours and premiums of a company's stored entries, loaded by the filter.
+// Per-day minimums and overtime thresholds count the employee's whole day and ISO week, so when the filter
+// cuts a period out they are worked out on every stored entry of the company, and of the filter's batch if it
+// has one, in the weeks the loaded entries fall in, and each loaded entry bills its own share. Entries of other
+// batches never count, so a batch is billed from its own data.
+func billStoredEntries(entries []TimeEntry, filter EntryFilter, settings BillingSettings) error {
+	if len(entries) == 0 || filter.BatchID == "" && filter.From.IsZero() && filter.To.IsZero() {
+		applyRounding(entries, settings.Rounding)
+		applyOvertime(entries, settings.Overtime)
+		return nil
+	}
+
+	from, to := entries[0].Date, entries[0].Date
+	for _, e := range entries {
+		if e.Date.Before(from) {
+			from = e.Date
+		}
+		if e.Date.After(to) {
+			to = e.Date
+		}
+	}
+	weeks, err := loadEntries(EntryFilter{Company: filter.Company, Aliases: filter.Aliases, BatchID: filter.BatchID, From: isoWeekStart(from), To: isoWeekStart(to).AddDate(0, 0, 6)})
+	if err != nil {
+		return err
+	}
+	applyRounding(weeks, settings.Rounding)
+	applyOvertime(weeks, settings.Overtime)
 
-		// update maps
-		company, exists := cm[cName]
-		if exists {
-			employee, exists := company[eid]
-			if exists {
-				employee.TotalHours += diff
-				company[eid] = employee
-			} else {
-				employee = Employee{BillableRate: bRate, TotalHours: diff}
-				company[eid] = employee
+	billed := make(map[int64]TimeEntry, len(weeks))
+	for _, e := range weeks {
+		billed[e.ID] = e
+	}
+	for i := range entries {
+		e := billed[entries[i].ID]
+		entries[i].BilledHours, entries[i].Premiums = e.BilledHours, e.Premiums
+	}
+	return nil
+}
+
+// isoWeekStart returns the Monday that starts the ISO week of a date
+func isoWeekStart(d time.Time) time.Time {
+	return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+}
+
+// rateWarnings reports employees billed at more than one rate for the same company
+func rateWarnings(cm CompanyMap) []string {
+	warnings := []string{}
+	for _, cName := range sortedKeys(cm) {
+		em := cm[cName]
+		ids := make([]int, 0, len(em))
+		for id := range em {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		for _, id := range ids {
+			// premium lines are billed at the same base rate
+			var rates []string
+			for _, r := range em[id].Rates {
+				value := strings.TrimSpace(fmt.Sprintf("%.2f %s", r.BillableRate, r.Currency))
+				if !slices.Contains(rates, value) {
+					rates = append(rates, value)
+				}
+			}
+			if len(rates) < 2 {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("employee %d is billed at %d rates for %s: %s", id, len(rates), cName, strings.Join(rates, ", ")))
+		}
+	}
+	return warnings
+}
+
+// sortedKeys returns the keys of a string-keyed map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveBatch creates a batch and stores its time entries in a single transaction
+func saveBatch(filename string, entries []TimeEntry) (Batch, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	batch, err := insertBatch(tx, filename, entries)
+	if err != nil {
+		return Batch{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Batch{}, fmt.Errorf("failed to commit batch: %w", err)
+	}
+	return batch, nil
+}
+
+// insertBatch creates a batch and stores its time entries in the transaction
+func insertBatch(tx *sql.Tx, filename string, entries []TimeEntry) (Batch, error) {
+	batch := Batch{
+		ID:         uuid.New().String(),
+		Filename:   filename,
+		EntryCount: len(entries),
+		CreatedAt:  time.Now(),
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO batches (id, filename, entry_count, created_at)
+		VALUES (?, ?, ?, ?)
+	`, batch.ID, batch.Filename, batch.EntryCount, batch.CreatedAt)
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to create batch: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO time_entries (batch_id, employee_id, billable_rate, currency, company, work_date, start_time, end_time, hours, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.Exec(batch.ID, e.EmployeeID, e.BillableRate, e.Currency, e.Company, e.Date, e.Start, e.End, e.Hours, batch.CreatedAt); err != nil {
+			return Batch{}, fmt.Errorf("failed to save time entry: %w", err)
+		}
+	}
+	return batch, nil
+}
+
+// listBatches returns all upload batches, newest first
+func listBatches() ([]Batch, error) {
+	rows, err := DB.Query(`
+		SELECT id, filename, entry_count, created_at
+		FROM batches
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list batches: %w", err)
+	}
+	defer rows.Close()
+
+	batches := []Batch{}
+	for rows.Next() {
+		var b Batch
+		if err := rows.Scan(&b.ID, &b.Filename, &b.EntryCount, &b.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read batch: %w", err)
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// getBatch looks up a single upload batch by id
+func getBatch(id string) (Batch, error) {
+	var b Batch
+	err := DB.QueryRow(`
+		SELECT id, filename, entry_count, created_at
+		FROM batches
+		WHERE id = ?
+	`, id).Scan(&b.ID, &b.Filename, &b.EntryCount, &b.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Batch{}, fmt.Errorf("batch %s not found", id)
+	}
+	if err != nil {
+		return Batch{}, fmt.Errorf("failed to load batch: %w", err)
+	}
+	return b, nil
+}
+
+// saveProfile creates or replaces a named import profile
+func saveProfile(p ImportProfile) (ImportProfile, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return ImportProfile{}, fmt.Errorf("profile name is required")
+	}
+	if len(p.Mapping) == 0 {
+		return ImportProfile{}, fmt.Errorf("profile mapping is required")
+	}
+	if err := p.Mapping.validate(); err != nil {
+		return ImportProfile{}, err
+	}
+
+	mapping, err := json.Marshal(p.Mapping)
+	if err != nil {
+		return ImportProfile{}, fmt.Errorf("failed to encode mapping: %w", err)
+	}
+	p.CreatedAt = time.Now()
+
+	_, err = DB.Exec(`
+		INSERT INTO import_profiles (name, mapping, created_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET mapping = excluded.mapping, created_at = excluded.created_at
+	`, p.Name, string(mapping), p.CreatedAt)
+	if err != nil {
+		return ImportProfile{}, fmt.Errorf("failed to save profile: %w", err)
+	}
+	return p, nil
+}
+
+// getProfile looks up a named import profile
+func getProfile(name string) (ImportProfile, error) {
+	var p ImportProfile
+	var mapping string
+	err := DB.QueryRow(`
+		SELECT name, mapping, created_at
+		FROM import_profiles
+		WHERE name = ?
+	`, name).Scan(&p.Name, &mapping, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ImportProfile{}, fmt.Errorf("import profile %s not found", name)
+	}
+	if err != nil {
+		return ImportProfile{}, fmt.Errorf("failed to load profile: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(mapping), &p.Mapping); err != nil {
+		return ImportProfile{}, fmt.Errorf("failed to decode mapping: %w", err)
+	}
+	return p, nil
+}
+
+// listProfiles returns all import profiles by name
+func listProfiles() ([]ImportProfile, error) {
+	rows, err := DB.Query(`
+		SELECT name, mapping, created_at
+		FROM import_profiles
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+	defer rows.Close()
+
+	profiles := []ImportProfile{}
+	for rows.Next() {
+		var p ImportProfile
+		var mapping string
+		if err := rows.Scan(&p.Name, &mapping, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read profile: %w", err)
+		}
+		if err := json.Unmarshal([]byte(mapping), &p.Mapping); err != nil {
+			return nil, fmt.Errorf("failed to decode mapping: %w", err)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
+
+// deleteProfile removes a named import profile
+func deleteProfile(name string) error {
+	res, err := DB.Exec(`DELETE FROM import_profiles WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete profile: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("import profile %s not found", name)
+	}
+	return nil
+}
+
+// loadEntries loads stored time entries matching the filter
+func loadEntries(filter EntryFilter) ([]TimeEntry, error) {
+	query := `
+		SELECT id, employee_id, billable_rate, currency, company, work_date, start_time, end_time, hours
+		FROM time_entries
+		WHERE 1 = 1`
+	var args []any
+	if filter.BatchID != "" {
+		query += " AND batch_id = ?"
+		args = append(args, filter.BatchID)
+	}
+	if filter.Company != "" {
+		query += " AND company IN (?" + strings.Repeat(", ?", len(filter.Aliases)) + ")"
+		args = append(args, filter.Company)
+		for _, alias := range filter.Aliases {
+			args = append(args, alias)
+		}
+	}
+	if !filter.From.IsZero() {
+		query += " AND work_date >= ?"
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += " AND work_date <= ?"
+		args = append(args, filter.To)
+	}
+	query += " ORDER BY work_date, id"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load time entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []TimeEntry
+	for rows.Next() {
+		var e TimeEntry
+		if err := rows.Scan(&e.ID, &e.EmployeeID, &e.BillableRate, &e.Currency, &e.Company, &e.Date, &e.Start, &e.End, &e.Hours); err != nil {
+			return nil, fmt.Errorf("failed to read time entry: %w", err)
+		}
+		if filter.Company != "" {
+			e.Company = filter.Company
+		}
+		e.BilledHours = e.Hours
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// listCompanies returns the companies with stored time entries matching the filter, in name order
+func listCompanies(filter EntryFilter) ([]string, error) {
+	query := `SELECT DISTINCT company FROM time_entries WHERE 1 = 1`
+	var args []any
+	if filter.BatchID != "" {
+		query += " AND batch_id = ?"
+		args = append(args, filter.BatchID)
+	}
+	if !filter.From.IsZero() {
+		query += " AND work_date >= ?"
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		query += " AND work_date <= ?"
+		args = append(args, filter.To)
+	}
+	query += " ORDER BY company"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list companies: %w", err)
+	}
+	defer rows.Close()
+
+	var companies []string
+	for rows.Next() {
+		var company string
+		if err := rows.Scan(&company); err != nil {
+			return nil, fmt.Errorf("failed to read company: %w", err)
+		}
+		companies = append(companies, company)
+	}
+	return companies, rows.Err()
+}
+
+// BillingSettings holds the invoicing rules for a single company
+type BillingSettings struct {
+	Company string
+	// Currency the company is billed in; fixed discounts are in this currency
+	Currency string
+	Taxes    []Tax
+	Discount *Discount
+	// Rounding adjusts the time billed per entry; nil bills time exactly
+	Rounding *RoundingPolicy
+	// Overtime bills hours past thresholds, and weekends, at a premium; nil bills every hour as regular
+	Overtime *OvertimePolicy
+}
+
+// Tax is a percentage tax added to an invoice. Taxes are applied in order;
+// a compound tax is charged on the discounted subtotal plus the taxes before it.
+type Tax struct {
+	Name     string
+	Rate     float64
+	Compound bool
+}
+
+// discount types
+const (
+	DiscountPercent = "percent"
+	DiscountFixed   = "fixed"
+)
+
+// Discount is a negotiated reduction of an invoice's subtotal, applied before tax
+type Discount struct {
+	Type        string
+	Value       float64
+	Description string
+}
+
+// TaxLine is a tax charged on an invoice; Base is the amount it was charged on
+type TaxLine struct {
+	Name   string
+	Rate   float64
+	Base   float64
+	Amount float64
+}
+
+// Totals is the money summary at the foot of an invoice
+type Totals struct {
+	Currency      string
+	Subtotal      float64
+	Discount      float64
+	DiscountLabel string
+	Taxes         []TaxLine
+	Tax           float64
+	Total         float64
+}
+
+// validate checks billing settings before they are stored
+func (b BillingSettings) validate() error {
+	if !isCurrencyCode(b.Currency) {
+		return fmt.Errorf("invalid currency %q, expected a 3-letter currency code", b.Currency)
+	}
+	for _, t := range b.Taxes {
+		if strings.TrimSpace(t.Name) == "" {
+			return fmt.Errorf("tax name is required")
+		}
+		if t.Rate < 0 {
+			return fmt.Errorf("tax %s: rate must not be negative", t.Name)
+		}
+	}
+	if d := b.Discount; d != nil {
+		switch d.Type {
+		case DiscountPercent:
+			if d.Value < 0 || d.Value > 100 {
+				return fmt.Errorf("percentage discount must be between 0 and 100")
+			}
+		case DiscountFixed:
+			if d.Value < 0 {
+				return fmt.Errorf("fixed discount must not be negative")
 			}
-		} else {
-			em := make(EmployeeMap)
-			em[eid] = Employee{BillableRate: bRate, TotalHours: diff}
-			cm[cName] = em
+		default:
+			return fmt.Errorf("discount type must be %s or %s, got %q", DiscountPercent, DiscountFixed, d.Type)
+		}
+	}
+	if b.Rounding != nil {
+		if err := b.Rounding.validate(); err != nil {
+			return err
 		}
+	}
+	if b.Overtime != nil {
+		return b.Overtime.validate()
+	}
+	return nil
+}
+
+// saveBillingSettings creates or replaces a company's billing settings
+func saveBillingSettings(b BillingSettings) (BillingSettings, error) {
+	b.Company = strings.TrimSpace(strings.ToLower(b.Company))
+	if b.Company == "" {
+		return BillingSettings{}, fmt.Errorf("company is required")
+	}
+	if b.Taxes == nil {
+		b.Taxes = []Tax{}
+	}
+	b.Currency = normalizeCurrency(b.Currency)
+	if b.Currency == "" {
+		b.Currency = defaultCurrency
+	}
+	if err := b.validate(); err != nil {
+		return BillingSettings{}, err
+	}
 
+	settings, err := json.Marshal(b)
+	if err != nil {
+		return BillingSettings{}, fmt.Errorf("failed to encode billing settings: %w", err)
 	}
 
-	companyMap = cm
-	return cm, nil
+	_, err = DB.Exec(`
+		INSERT INTO company_billing (company, settings, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (company) DO UPDATE SET settings = excluded.settings, updated_at = excluded.updated_at
+	`, b.Company, string(settings), time.Now())
+	if err != nil {
+		return BillingSettings{}, fmt.Errorf("failed to save billing settings: %w", err)
+	}
+	return b, nil
 }
 
-// generateInvoice creates a PDF invoice for the specified company
-func generateInvoice(companyName string) (string, error) {
-	cName := strings.TrimSpace(strings.ToLower(companyName))
+// getBillingSettings loads a company's billing settings, returning the defaults
+// (default currency, no taxes, no discount) for companies without any
+func getBillingSettings(company string) (BillingSettings, error) {
+	b := BillingSettings{Company: strings.TrimSpace(strings.ToLower(company)), Currency: defaultCurrency, Taxes: []Tax{}}
 
-	employees, exists := companyMap[cName]
-	if !exists {
-		return "", fmt.Errorf("company %s not found", cName)
+	var settings string
+	err := DB.QueryRow(`SELECT settings FROM company_billing WHERE company = ?`, b.Company).Scan(&settings)
+	if err == sql.ErrNoRows {
+		return b, nil
+	}
+	if err != nil {
+		return BillingSettings{}, fmt.Errorf("failed to load billing settings: %w", err)
 	}
 
-	// create new pdf file
-	pdf := fpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
+	if err := json.Unmarshal([]byte(settings), &b); err != nil {
+		return BillingSettings{}, fmt.Errorf("failed to decode billing settings: %w", err)
+	}
+	return b, nil
+}
 
-	// file header
-	pdf.SetFont("Arial", "", 16)
-	pdf.Cell(40, 10, "Company: "+companyName)
-	pdf.Ln(20)
+// rounding rules:
+// - amounts are kept in whole cents, rounding half away from zero
+// - each invoice line (employee, rate) is rounded, and the subtotal is the sum of rounded lines
+// - a percentage discount is taken from the subtotal and rounded; a fixed one is capped at the subtotal
+// - each tax is computed on its base (discounted subtotal, plus earlier taxes if compound) and rounded
+// - the total is the discounted subtotal plus the rounded taxes, so the printed lines always add up
 
-	// table header
-	pdf.SetFont("Arial", "B", 12)
-	pdf.SetFillColor(0, 102, 204)
-	pdf.SetTextColor(255, 255, 255)
-	pdf.CellFormat(40, 10, "Employee ID", "TBR", 0, "", true, 0, "")
-	pdf.CellFormat(40, 10, "Number of Hours", "1", 0, "", true, 0, "")
-	pdf.CellFormat(40, 10, "Unit Price", "1", 0, "", true, 0, "")
-	pdf.CellFormat(40, 10, "Cost", "TBL", 0, "", true, 0, "")
-	pdf.Ln(-1)
+// toCents converts an amount to whole cents, rounding half away from zero
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
 
-	// table body
-	pdf.SetFont("Arial", "", 12)
-	pdf.SetTextColor(0, 0, 0)
-	totalCost := 0.0
+// percentOf returns pct percent of an amount in cents, rounding half away from zero
+func percentOf(cents int64, pct float64) int64 {
+	return int64(math.Round(float64(cents) * pct / 100))
+}
 
-	for i, emp := range employees {
-		cost := emp.TotalHours * emp.BillableRate
-		totalCost += cost
+// fromCents converts whole cents back to an amount
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
 
-		pdf.CellFormat(40, 7, ""+strconv.Itoa(i), "TBR", 0, "R", false, 0, "")
-		pdf.CellFormat(40, 7, fmt.Sprintf("%.2f", emp.TotalHours), "1", 0, "R", false, 0, "")
-		pdf.CellFormat(40, 7, fmt.Sprintf("%.2f", emp.BillableRate), "1", 0, "R", false, 0, "")
-		pdf.CellFormat(40, 7, fmt.Sprintf("%.2f", cost), "TBL", 0, "R", false, 0, "")
-		pdf.Ln(-1)
+// lineCost returns the rounded cost of an employee's invoice lines
+func lineCost(emp Employee) float64 {
+	var cents int64
+	for _, line := range emp.Rates {
+		cents += toCents(line.Cost)
 	}
+	return fromCents(cents)
+}
 
-	// totals
-	pdf.SetFont("Arial", "", 12)
-	pdf.CellFormat(40, 7, "", "TBR", 0, "C", false, 0, "")
-	pdf.CellFormat(40, 7, "", "1", 0, "C", false, 0, "")
-	pdf.SetFont("Arial", "B", 12)
-	pdf.CellFormat(40, 7, "Total", "1", 0, "", false, 0, "")
-	pdf.SetFont("Arial", "", 12)
-	pdf.CellFormat(40, 7, fmt.Sprintf("%.2f", totalCost), "TBL", 0, "R", false, 0, "")
-	pdf.Ln(-1)
+// computeTotals applies the company's discount and taxes to the invoice lines,
+// whose costs must already be in the company's currency
+func computeTotals(employees EmployeeMap, settings BillingSettings) Totals {
+	var subtotal int64
+	for _, emp := range employees {
+		subtotal += toCents(lineCost(emp))
+	}
 
-	filename := cName + "_invoice.pdf"
-	return filename, pdf.OutputFileAndClose(filename)
+	var discount int64
+	label := ""
+	if d := settings.Discount; d != nil {
+		switch d.Type {
+		case DiscountPercent:
+			discount = percentOf(subtotal, d.Value)
+			label = fmt.Sprintf("Discount (%g%%)", d.Value)
+		case DiscountFixed:
+			discount = min(toCents(d.Value), subtotal)
+			label = "Discount"
+		}
+		if d.Description != "" {
+			label += " - " + d.Description
+		}
+	}
+
+	taxable := subtotal - discount
+	var taxTotal int64
+	taxes := []TaxLine{}
+	for _, t := range settings.Taxes {
+		base := taxable
+		if t.Compound {
+			base += taxTotal
+		}
+		amount := percentOf(base, t.Rate)
+		taxTotal += amount
+		taxes = append(taxes, TaxLine{Name: t.Name, Rate: t.Rate, Base: fromCents(base), Amount: fromCents(amount)})
+	}
+
+	return Totals{
+		Currency:      settings.Currency,
+		Subtotal:      fromCents(subtotal),
+		Discount:      fromCents(discount),
+		DiscountLabel: label,
+		Taxes:         taxes,
+		Tax:           fromCents(taxTotal),
+		Total:         fromCents(taxable + taxTotal),
+	}
 }
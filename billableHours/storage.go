@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// invoice storage:
+// - invoices are rendered in memory and streamed to the client; nothing is written by default
+// - when invoiceStorageDir is set, every issued (non-draft) invoice is also kept there,
+//   named after its number so concurrent downloads never share a file
+// - files are written to a temporary name and renamed, so a reader never sees a partial invoice
+// - retention: files older than invoiceRetentionDays are removed, then the oldest beyond
+//   invoiceRetentionCount; zero disables a rule
+
+// invoice storage settings, set through the environment in main
+var (
+	invoiceStorageDir     = ""
+	invoiceRetentionDays  = 0
+	invoiceRetentionCount = 0
+)
+
+// storeInvoice keeps a copy of an issued invoice in the storage directory and applies the retention rules
+func storeInvoice(out renderedInvoice) error {
+	if invoiceStorageDir == "" || out.Number == "" {
+		return nil
+	}
+	if err := os.MkdirAll(invoiceStorageDir, 0755); err != nil {
+		return fmt.Errorf("failed to create invoice storage: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(invoiceStorageDir, ".invoice-*")
+	if err != nil {
+		return fmt.Errorf("failed to store invoice: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out.Content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to store invoice: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store invoice: %w", err)
+	}
+
+	name := filepath.Join(invoiceStorageDir, safeFilename(out.Number)+"_"+out.Filename)
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to store invoice: %w", err)
+	}
+
+	return pruneInvoices(time.Now())
+}
+
+// pruneInvoices removes stored invoices that fall outside the retention rules
+func pruneInvoices(now time.Time) error {
+	if invoiceStorageDir == "" || (invoiceRetentionDays <= 0 && invoiceRetentionCount <= 0) {
+		return nil
+	}
+
+	dirEntries, err := os.ReadDir(invoiceStorageDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read invoice storage: %w", err)
+	}
+
+	type stored struct {
+		path    string
+		modTime time.Time
+	}
+	var files []stored
+	for _, d := range dirEntries {
+		// skip directories and files still being written
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, stored{path: filepath.Join(invoiceStorageDir, d.Name()), modTime: info.ModTime()})
+	}
+
+	// newest first, so everything past the count limit is the oldest
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	cutoff := now.AddDate(0, 0, -invoiceRetentionDays)
+	kept := 0
+	for _, f := range files {
+		expired := invoiceRetentionDays > 0 && f.modTime.Before(cutoff)
+		if !expired && (invoiceRetentionCount <= 0 || kept < invoiceRetentionCount) {
+			kept++
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stored invoice: %w", err)
+		}
+	}
+	return nil
+}
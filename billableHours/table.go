@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// invoice tables:
+// - layoutTable turns an invoice document into the rows and columns of its table, for the PDF and HTML renderers
+// - a column is shown when it applies to the invoice (e.g. worked hours only when time is rounded)
+//   and the invoice's template includes it
+// - summary tables have a line per employee and rate; itemised tables a heading per employee,
+//   their entries and a subtotal row
+// - grouped invoices (see ordering.go) head each section and close it with the section's subtotal
+
+// table columns, in the order they are laid out
+const (
+	ColumnEmployee = "employee"
+	ColumnRole     = "role"
+	ColumnDate     = "date"
+	ColumnStart    = "start"
+	ColumnEnd      = "end"
+	ColumnWorked   = "worked"
+	ColumnHours    = "hours"
+	ColumnType     = "type"
+	ColumnRate     = "rate"
+	ColumnCost     = "cost"
+)
+
+// tableColumnKeys lists every table column
+var tableColumnKeys = []string{
+	ColumnEmployee, ColumnRole, ColumnDate, ColumnStart, ColumnEnd,
+	ColumnWorked, ColumnHours, ColumnType, ColumnRate, ColumnCost,
+}
+
+// table row kinds
+const (
+	RowLine            = "line"
+	RowGroup           = "group"
+	RowEntry           = "entry"
+	RowSubtotal        = "subtotal"
+	RowSection         = "section"
+	RowSectionSubtotal = "section-subtotal"
+)
+
+// tableColumn is a column of an invoice table, with its natural width in the PDF
+type tableColumn struct {
+	Key   string
+	Title string
+	Width float64
+}
+
+// tableRow is a row of an invoice table: a cell per column, or a single heading cell for a group
+// or section. Amount is the row's cost, for the running subtotal carried from page to page.
+type tableRow struct {
+	Kind   string
+	Cells  []string
+	Amount float64
+}
+
+// invoiceTable is an invoice's table, laid out for its template
+type invoiceTable struct {
+	Columns []tableColumn
+	Rows    []tableRow
+}
+
+// layoutTable lays out the table of an invoice document
+func layoutTable(doc InvoiceDocument) invoiceTable {
+	var candidates []tableColumn
+	hoursTitle := "Hours"
+	if doc.Rounded {
+		hoursTitle = "Billed"
+	}
+	if doc.Itemised {
+		candidates = []tableColumn{
+			{ColumnDate, "Date", 30},
+			{ColumnStart, "Start", 24},
+			{ColumnEnd, "End", 24},
+			{ColumnWorked, "Worked", 26},
+			{ColumnHours, hoursTitle, 26},
+			{ColumnType, "Type", 34},
+			{ColumnRate, "Rate", 26},
+			{ColumnCost, "Cost", 30},
+		}
+	} else {
+		if !doc.Rounded {
+			hoursTitle = "Number of Hours"
+		}
+		candidates = []tableColumn{
+			{ColumnEmployee, "Employee", 50},
+			{ColumnRole, "Role", 40},
+			{ColumnWorked, "Worked", 40},
+			{ColumnHours, hoursTitle, 40},
+			{ColumnType, "Type", 40},
+			{ColumnRate, "Unit Price", 40},
+			{ColumnCost, "Cost", 40},
+		}
+	}
+
+	applies := map[string]bool{
+		ColumnRole:   hasRoles(doc),
+		ColumnWorked: doc.Rounded,
+		ColumnType:   doc.Premiums,
+	}
+	columns := defaultTemplate.Columns
+	if len(doc.template.Columns) > 0 {
+		columns = doc.template.Columns
+	}
+
+	var table invoiceTable
+	for _, c := range candidates {
+		if shown, conditional := applies[c.Key]; conditional && !shown {
+			continue
+		}
+		if slices.Contains(columns, c.Key) {
+			table.Columns = append(table.Columns, c)
+		}
+	}
+
+	// subtotal labels sit just before the hours
+	label := table.Columns[0].Key
+	for i, c := range table.Columns {
+		if c.Key == ColumnWorked || c.Key == ColumnHours {
+			if i > 0 {
+				label = table.Columns[i-1].Key
+			}
+			break
+		}
+	}
+	subtotal := func(kind string, hours, rawHours, cost float64) {
+		table.add(kind, cost, map[string]string{
+			label:        "Subtotal",
+			ColumnWorked: fmt.Sprintf("%.2f", rawHours),
+			ColumnHours:  fmt.Sprintf("%.2f", hours),
+			ColumnCost:   formatMoney(cost, doc.Currency),
+		})
+	}
+
+	// sections follow each other in doc.Sections order; each is headed where it starts
+	// and subtotalled where it ends
+	var current string
+	next := 0
+	endSection := func() {
+		if current == "" {
+			return
+		}
+		s := doc.Sections[next]
+		next++
+		subtotal(RowSectionSubtotal, s.Hours, s.RawHours, s.Cost)
+		current = ""
+	}
+	startSection := func(name string) {
+		if name == current {
+			return
+		}
+		endSection()
+		if name != "" {
+			table.Rows = append(table.Rows, tableRow{Kind: RowSection, Cells: []string{name}})
+		}
+		current = name
+	}
+
+	if !doc.Itemised {
+		for _, line := range doc.Lines {
+			startSection(line.Section)
+			table.add(RowLine, line.Cost, map[string]string{
+				ColumnEmployee: employeeCell(line.EmployeeID, line.EmployeeName),
+				ColumnRole:     line.EmployeeRole,
+				ColumnWorked:   fmt.Sprintf("%.2f", line.RawHours),
+				ColumnHours:    fmt.Sprintf("%.2f", line.Hours),
+				ColumnType:     line.Type,
+				ColumnRate:     formatMoney(line.Rate*line.Multiplier, line.RateCurrency),
+				ColumnCost:     formatMoney(line.Cost, doc.Currency),
+			})
+		}
+		endSection()
+		return table
+	}
+
+	for _, g := range doc.Groups {
+		startSection(g.Section)
+		table.Rows = append(table.Rows, tableRow{Kind: RowGroup, Cells: []string{employeeHeading(g)}})
+		for _, e := range g.Entries {
+			table.add(RowEntry, e.Cost, map[string]string{
+				ColumnDate:   e.Date.Format(dateLayout),
+				ColumnStart:  e.Start.Format(clockLayout),
+				ColumnEnd:    e.End.Format(clockLayout),
+				ColumnWorked: fmt.Sprintf("%.2f", e.RawHours),
+				ColumnHours:  fmt.Sprintf("%.2f", e.Hours),
+				ColumnType:   e.Type,
+				ColumnRate:   formatMoney(e.Rate*e.Multiplier, e.RateCurrency),
+				ColumnCost:   formatMoney(e.Cost, doc.Currency),
+			})
+		}
+
+		// subtotals match the rounded invoice lines the totals are built from
+		subtotal(RowSubtotal, g.Hours, g.RawHours, g.Cost)
+	}
+	endSection()
+	return table
+}
+
+// add appends a row with a cell for each column, empty where there is no value
+func (t *invoiceTable) add(kind string, amount float64, values map[string]string) {
+	cells := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cells[i] = values[c.Key]
+	}
+	t.Rows = append(t.Rows, tableRow{Kind: kind, Cells: cells, Amount: amount})
+}
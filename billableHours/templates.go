@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoice templates:
+// - a template brands the PDF and HTML invoices: logo, colours, font, columns, footer and paper size
+// - templates are stored by name and managed through the API; the logo can be uploaded on its own
+// - each client may name a template; other invoices use defaultTemplate
+// - a template in use by a client cannot be deleted
+// - Columns picks which table columns are shown, when they apply to the invoice (see layoutTable);
+//   hours and cost are always needed, as the totals block sits under them
+
+// paper sizes
+const (
+	PaperA4     = "A4"
+	PaperLetter = "Letter"
+)
+
+// InvoiceTemplate is the branding of an invoice. Colours are "#RRGGBB"; the font is one of the
+// PDF core fonts (Arial, Times or Courier). Empty fields fall back to defaultTemplate.
+type InvoiceTemplate struct {
+	Name string
+	// Logo is a PNG or JPEG image printed at the top right, base64 encoded in JSON
+	Logo            []byte
+	Font            string
+	AccentColor     string
+	HeaderTextColor string
+	TextColor       string
+	Columns         []string
+	// Footer is printed at the bottom of every page, e.g. bank details and payment terms
+	Footer    string
+	PaperSize string
+	UpdatedAt time.Time
+}
+
+// defaultTemplate is the built-in layout: Arial, a blue header row and every column, on A4
+var defaultTemplate = InvoiceTemplate{
+	Font:            "Arial",
+	AccentColor:     "#0066CC",
+	HeaderTextColor: "#FFFFFF",
+	TextColor:       "#000000",
+	Columns:         tableColumnKeys,
+	PaperSize:       PaperA4,
+}
+
+// templateFonts maps the supported fonts to their CSS font stacks for HTML invoices
+var templateFonts = map[string]string{
+	"Arial":   "Arial, Helvetica, sans-serif",
+	"Times":   "'Times New Roman', Times, serif",
+	"Courier": "'Courier New', Courier, monospace",
+}
+
+// withDefaults fills the empty fields of a template from defaultTemplate
+func (t InvoiceTemplate) withDefaults() InvoiceTemplate {
+	if t.Font == "" {
+		t.Font = defaultTemplate.Font
+	}
+	if t.AccentColor == "" {
+		t.AccentColor = defaultTemplate.AccentColor
+	}
+	if t.HeaderTextColor == "" {
+		t.HeaderTextColor = defaultTemplate.HeaderTextColor
+	}
+	if t.TextColor == "" {
+		t.TextColor = defaultTemplate.TextColor
+	}
+	if len(t.Columns) == 0 {
+		t.Columns = defaultTemplate.Columns
+	}
+	if t.PaperSize == "" {
+		t.PaperSize = defaultTemplate.PaperSize
+	}
+	return t
+}
+
+// validate checks a template before it is stored
+func (t InvoiceTemplate) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("template name is required")
+	}
+	if _, ok := templateFonts[t.Font]; !ok {
+		return fmt.Errorf("font must be Arial, Times or Courier, got %q", t.Font)
+	}
+	for _, c := range []string{t.AccentColor, t.HeaderTextColor, t.TextColor} {
+		if _, _, _, err := parseColor(c); err != nil {
+			return err
+		}
+	}
+	for _, key := range t.Columns {
+		if !slices.Contains(tableColumnKeys, key) {
+			return fmt.Errorf("unknown column %q, expected one of %s", key, strings.Join(tableColumnKeys, ", "))
+		}
+	}
+	if !slices.Contains(t.Columns, ColumnHours) || !slices.Contains(t.Columns, ColumnCost) {
+		return fmt.Errorf("columns must include %s and %s", ColumnHours, ColumnCost)
+	}
+	if t.PaperSize != PaperA4 && t.PaperSize != PaperLetter {
+		return fmt.Errorf("paper size must be %s or %s, got %q", PaperA4, PaperLetter, t.PaperSize)
+	}
+	if len(t.Logo) > 0 && logoType(t.Logo) == "" {
+		return fmt.Errorf("logo must be a PNG or JPEG image")
+	}
+	return nil
+}
+
+// parseColor reads a "#RRGGBB" colour
+func parseColor(color string) (r, g, b int, err error) {
+	hex, ok := strings.CutPrefix(color, "#")
+	if !ok || len(hex) != 6 {
+		return 0, 0, 0, fmt.Errorf("invalid colour %q, expected #RRGGBB", color)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid colour %q, expected #RRGGBB", color)
+	}
+	return int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff), nil
+}
+
+// logoType returns the image type of a logo, PNG or JPG, or "" when it is neither
+func logoType(logo []byte) string {
+	switch http.DetectContentType(logo) {
+	case "image/png":
+		return "PNG"
+	case "image/jpeg":
+		return "JPG"
+	default:
+		return ""
+	}
+}
+
+// saveTemplate creates or replaces a named invoice template
+func saveTemplate(t InvoiceTemplate) (InvoiceTemplate, error) {
+	t.Name = strings.TrimSpace(t.Name)
+	t.Font = strings.TrimSpace(t.Font)
+	t.AccentColor = strings.ToUpper(strings.TrimSpace(t.AccentColor))
+	t.HeaderTextColor = strings.ToUpper(strings.TrimSpace(t.HeaderTextColor))
+	t.TextColor = strings.ToUpper(strings.TrimSpace(t.TextColor))
+	for i := range t.Columns {
+		t.Columns[i] = strings.ToLower(strings.TrimSpace(t.Columns[i]))
+	}
+	t = t.withDefaults()
+	if err := t.validate(); err != nil {
+		return InvoiceTemplate{}, err
+	}
+	t.UpdatedAt = time.Now()
+
+	encoded, err := json.Marshal(t)
+	if err != nil {
+		return InvoiceTemplate{}, fmt.Errorf("failed to encode template: %w", err)
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO invoice_templates (name, template, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET template = excluded.template, updated_at = excluded.updated_at
+	`, t.Name, string(encoded), t.UpdatedAt)
+	if err != nil {
+		return InvoiceTemplate{}, fmt.Errorf("failed to save template: %w", err)
+	}
+	return t, nil
+}
+
+// getTemplate looks up a named invoice template
+func getTemplate(name string) (InvoiceTemplate, error) {
+	var encoded string
+	err := DB.QueryRow(`SELECT template FROM invoice_templates WHERE name = ?`, name).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return InvoiceTemplate{}, fmt.Errorf("invoice template %s not found", name)
+	}
+	if err != nil {
+		return InvoiceTemplate{}, fmt.Errorf("failed to load template: %w", err)
+	}
+
+	var t InvoiceTemplate
+	if err := json.Unmarshal([]byte(encoded), &t); err != nil {
+		return InvoiceTemplate{}, fmt.Errorf("failed to decode template: %w", err)
+	}
+	return t, nil
+}
+
+// listTemplates returns all invoice templates by name
+func listTemplates() ([]InvoiceTemplate, error) {
+	rows, err := DB.Query(`SELECT template FROM invoice_templates ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	defer rows.Close()
+
+	templates := []InvoiceTemplate{}
+	for rows.Next() {
+		var encoded string
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, fmt.Errorf("failed to read template: %w", err)
+		}
+		var t InvoiceTemplate
+		if err := json.Unmarshal([]byte(encoded), &t); err != nil {
+			return nil, fmt.Errorf("failed to decode template: %w", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// deleteTemplate removes a named invoice template, unless a client still uses it
+func deleteTemplate(name string) error {
+	var client string
+	err := DB.QueryRow(`SELECT name FROM clients WHERE template = ? ORDER BY lower(name) LIMIT 1`, name).Scan(&client)
+	if err == nil {
+		return fmt.Errorf("invoice template %s is used by client %s", name, client)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check template use: %w", err)
+	}
+
+	res, err := DB.Exec(`DELETE FROM invoice_templates WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete template: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("invoice template %s not found", name)
+	}
+	return nil
+}
+
+// clientTemplate returns the template an invoice for the client is laid out with
+func clientTemplate(client *Client) (InvoiceTemplate, error) {
+	if client == nil || client.Template == "" {
+		return defaultTemplate, nil
+	}
+	t, err := getTemplate(client.Template)
+	if err != nil {
+		return InvoiceTemplate{}, err
+	}
+	return t.withDefaults(), nil
+}
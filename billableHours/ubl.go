@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// UBL 2.1 invoices:
+// - one InvoiceLine per employee and rate, quantity in hours (UN/ECE unit HUR)
+// - prices and amounts are in the invoice currency; the discount is a document level allowance
+// - each tax is a TaxSubtotal under a single TaxTotal, its scheme named after the tax
+// - the supplier party carries supplierName when it is configured
+// - the customer party carries the client's legal name, address, tax ID and email, and the
+//   client's PO number is the order reference
+
+// supplierName is the invoicing party on structured invoices, set through the environment in main
+var supplierName = ""
+
+// ublRenderer writes the invoice as a UBL 2.1 XML invoice
+type ublRenderer struct{}
+
+func (ublRenderer) ContentType() string { return "application/xml" }
+func (ublRenderer) Extension() string   { return "xml" }
+
+func (ublRenderer) Render(w io.Writer, doc InvoiceDocument) error {
+	amount := func(value float64) ublAmount {
+		return ublAmount{Currency: doc.Currency, Value: strconv.FormatFloat(value, 'f', 2, 64)}
+	}
+
+	inv := ublInvoice{
+		Xmlns:           "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2",
+		Cac:             "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2",
+		Cbc:             "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2",
+		UBLVersionID:    "2.1",
+		ID:              invoiceNumber(doc),
+		IssueDate:       doc.IssueDate.Format(dateLayout),
+		DueDate:         doc.DueDate.Format(dateLayout),
+		InvoiceTypeCode: "380",
+		Currency:        doc.Currency,
+		Period:          ublPeriod{StartDate: doc.PeriodFrom.Format(dateLayout), EndDate: doc.PeriodTo.Format(dateLayout)},
+		Customer:        ublParty{Party: ublPartyDetail{PartyName: &ublPartyName{Name: doc.CompanyName}}},
+		TaxTotal:        ublTaxTotal{TaxAmount: amount(doc.Tax)},
+		MonetaryTotal: ublMonetaryTotal{
+			LineExtensionAmount: amount(doc.Subtotal),
+			TaxExclusiveAmount:  amount(doc.Subtotal - doc.Discount),
+			TaxInclusiveAmount:  amount(doc.Total),
+			PayableAmount:       amount(doc.Total),
+		},
+	}
+
+	if c := doc.Client; c != nil {
+		customer := &inv.Customer.Party
+		if lines := c.AddressLines(); len(lines) > 0 {
+			customer.Address = &ublAddress{}
+			for _, line := range lines {
+				customer.Address.Lines = append(customer.Address.Lines, ublAddressLine{Line: line})
+			}
+		}
+		if c.TaxID != "" {
+			customer.TaxScheme = &ublPartyTaxScheme{CompanyID: c.TaxID, SchemeID: "VAT"}
+		}
+		if c.LegalName != "" {
+			customer.LegalEntity = &ublLegalEntity{RegistrationName: c.LegalName}
+		}
+		if c.Email != "" {
+			customer.Contact = &ublContact{Email: c.Email}
+		}
+		if c.PONumber != "" {
+			inv.Order = &ublOrderReference{ID: c.PONumber}
+		}
+	}
+	if supplierName != "" {
+		inv.Supplier.Party.PartyName = &ublPartyName{Name: supplierName}
+	}
+	if doc.Discount != 0 {
+		discount := amount(doc.Discount)
+		inv.Allowances = append(inv.Allowances, ublAllowanceCharge{Reason: doc.Totals.DiscountLabel, Amount: discount})
+		inv.MonetaryTotal.AllowanceTotalAmount = &discount
+	}
+	for _, t := range doc.Totals.Taxes {
+		inv.TaxTotal.Subtotals = append(inv.TaxTotal.Subtotals, ublTaxSubtotal{
+			TaxableAmount: amount(t.Base),
+			TaxAmount:     amount(t.Amount),
+			Category:      ublTaxCategory{ID: "S", Percent: strconv.FormatFloat(t.Rate, 'f', -1, 64), SchemeID: t.Name},
+		})
+	}
+	for i, line := range doc.Lines {
+		description := fmt.Sprintf("Billable hours at %s", formatMoney(line.Rate, line.RateCurrency))
+		if line.Premium != "" {
+			description = fmt.Sprintf("%s hours at %s", line.Type, formatMoney(line.Rate, line.RateCurrency))
+		}
+		name := employeeLabel(line.EmployeeID, line.EmployeeName)
+		if line.EmployeeRole != "" {
+			name += " (" + line.EmployeeRole + ")"
+		}
+		inv.Lines = append(inv.Lines, ublInvoiceLine{
+			ID:                  strconv.Itoa(i + 1),
+			Quantity:            ublQuantity{UnitCode: "HUR", Value: strconv.FormatFloat(line.Hours, 'f', 2, 64)},
+			LineExtensionAmount: amount(line.Cost),
+			Item: ublItem{
+				Description: description,
+				Name:        name,
+			},
+			Price: ublPrice{PriceAmount: amount(line.UnitPrice)},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(inv); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// ublInvoice is the subset of the UBL 2.1 Invoice document we produce; fields are in schema order
+type ublInvoice struct {
+	XMLName         xml.Name             `xml:"Invoice"`
+	Xmlns           string               `xml:"xmlns,attr"`
+	Cac             string               `xml:"xmlns:cac,attr"`
+	Cbc             string               `xml:"xmlns:cbc,attr"`
+	UBLVersionID    string               `xml:"cbc:UBLVersionID"`
+	ID              string               `xml:"cbc:ID"`
+	IssueDate       string               `xml:"cbc:IssueDate"`
+	DueDate         string               `xml:"cbc:DueDate"`
+	InvoiceTypeCode string               `xml:"cbc:InvoiceTypeCode"`
+	Currency        string               `xml:"cbc:DocumentCurrencyCode"`
+	Period          ublPeriod            `xml:"cac:InvoicePeriod"`
+	Order           *ublOrderReference   `xml:"cac:OrderReference"`
+	Supplier        ublParty             `xml:"cac:AccountingSupplierParty"`
+	Customer        ublParty             `xml:"cac:AccountingCustomerParty"`
+	Allowances      []ublAllowanceCharge `xml:"cac:AllowanceCharge"`
+	TaxTotal        ublTaxTotal          `xml:"cac:TaxTotal"`
+	MonetaryTotal   ublMonetaryTotal     `xml:"cac:LegalMonetaryTotal"`
+	Lines           []ublInvoiceLine     `xml:"cac:InvoiceLine"`
+}
+
+type ublAmount struct {
+	Currency string `xml:"currencyID,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ublQuantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ublPeriod struct {
+	StartDate string `xml:"cbc:StartDate"`
+	EndDate   string `xml:"cbc:EndDate"`
+}
+
+type ublParty struct {
+	Party ublPartyDetail `xml:"cac:Party"`
+}
+
+type ublOrderReference struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type ublPartyDetail struct {
+	PartyName   *ublPartyName      `xml:"cac:PartyName"`
+	Address     *ublAddress        `xml:"cac:PostalAddress"`
+	TaxScheme   *ublPartyTaxScheme `xml:"cac:PartyTaxScheme"`
+	LegalEntity *ublLegalEntity    `xml:"cac:PartyLegalEntity"`
+	Contact     *ublContact        `xml:"cac:Contact"`
+}
+
+type ublPartyName struct {
+	Name string `xml:"cbc:Name"`
+}
+
+type ublAddress struct {
+	Lines []ublAddressLine `xml:"cac:AddressLine"`
+}
+
+type ublAddressLine struct {
+	Line string `xml:"cbc:Line"`
+}
+
+type ublPartyTaxScheme struct {
+	CompanyID string `xml:"cbc:CompanyID"`
+	SchemeID  string `xml:"cac:TaxScheme>cbc:ID"`
+}
+
+type ublLegalEntity struct {
+	RegistrationName string `xml:"cbc:RegistrationName"`
+}
+
+type ublContact struct {
+	Email string `xml:"cbc:ElectronicMail"`
+}
+
+type ublAllowanceCharge struct {
+	ChargeIndicator bool      `xml:"cbc:ChargeIndicator"`
+	Reason          string    `xml:"cbc:AllowanceChargeReason,omitempty"`
+	Amount          ublAmount `xml:"cbc:Amount"`
+}
+
+type ublTaxTotal struct {
+	TaxAmount ublAmount        `xml:"cbc:TaxAmount"`
+	Subtotals []ublTaxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     ublAmount      `xml:"cbc:TaxAmount"`
+	Category      ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublTaxCategory struct {
+	ID       string `xml:"cbc:ID"`
+	Percent  string `xml:"cbc:Percent"`
+	SchemeID string `xml:"cac:TaxScheme>cbc:ID"`
+}
+
+type ublMonetaryTotal struct {
+	LineExtensionAmount  ublAmount  `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount   ublAmount  `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount   ublAmount  `xml:"cbc:TaxInclusiveAmount"`
+	AllowanceTotalAmount *ublAmount `xml:"cbc:AllowanceTotalAmount"`
+	PayableAmount        ublAmount  `xml:"cbc:PayableAmount"`
+}
+
+type ublInvoiceLine struct {
+	ID                  string      `xml:"cbc:ID"`
+	Quantity            ublQuantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount   `xml:"cbc:LineExtensionAmount"`
+	Item                ublItem     `xml:"cac:Item"`
+	Price               ublPrice    `xml:"cac:Price"`
+}
+
+type ublItem struct {
+	Description string `xml:"cbc:Description"`
+	Name        string `xml:"cbc:Name"`
+}
+
+type ublPrice struct {
+	PriceAmount ublAmount `xml:"cbc:PriceAmount"`
+}
@@ -1,26 +1,50 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/zlib"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"image"
+	"image/png"
 	"io"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf16"
 )
 
 func TestReadCSV(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
 	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
 "1","100","Acme","7/1/19","09:00","11:00"
 "1","100","Acme","7/1/19","12:00","14:00"
 "2","150","Acme","7/1/19","10:00","15:00"
 `
-	cm, err := readCSV(strings.NewReader(csv))
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
 	if err != nil {
 		t.Fatalf("readCSV returned error: %v", err)
 	}
+	cm := res.Companies
 
 	// assertions?
 	if len(cm) != 1 {
@@ -51,6 +75,10 @@ func TestReadCSV(t *testing.T) {
 }
 
 func TestUploadCSV(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
 
@@ -81,38 +109,52 @@ func TestUploadCSV(t *testing.T) {
 }
 
 func TestGenerateInvoice_NoCompany(t *testing.T) {
-	companyMap = CompanyMap{}
-	_, err := generateInvoice("SomeCompany")
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	_, err := generateInvoice("SomeCompany", EntryFilter{}, InvoiceOptions{})
 	if err == nil {
 		t.Fatal("expected error for missing company, got nil")
 	}
 }
 
 func TestGenerateInvoice_Success(t *testing.T) {
-	companyMap = CompanyMap{
-		"google": {
-			1: {BillableRate: 100, TotalHours: 5},
-		},
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
 	}
 
-	filename, err := generateInvoice("Google")
+	_, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 1, BillableRate: 100, Company: "google", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 14, 0, 0, 0, time.UTC), Hours: 5},
+	})
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatalf("failed to save entries: %v", err)
 	}
 
-	defer os.Remove(filename)
+	out, err := generateInvoice("Google", EntryFilter{}, InvoiceOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-	// check that file exists when created
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		t.Fatalf("expected file %v to exist", filename)
+	// rendered in memory, nothing is left in the working directory
+	if out.Filename != "google_invoice.pdf" || !bytes.HasPrefix(out.Content, []byte("%PDF")) {
+		t.Fatalf("expected a PDF named google_invoice.pdf, got %s (%d bytes)", out.Filename, len(out.Content))
+	}
+	if _, err := os.Stat(out.Filename); !os.IsNotExist(err) {
+		t.Fatalf("expected no file %v to be written", out.Filename)
 	}
 }
 
 func TestDownloadInvoice(t *testing.T) {
-	companyMap = CompanyMap{
-		"netflix": {
-			1: {BillableRate: 100, TotalHours: 5},
-		},
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	_, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 1, BillableRate: 100, Company: "netflix", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 14, 0, 0, 0, time.UTC), Hours: 5},
+	})
+	if err != nil {
+		t.Fatalf("failed to save entries: %v", err)
 	}
 
 	req := httptest.NewRequest("GET", "/api/download/Netflix", nil)
@@ -131,3 +173,2223 @@ func TestDownloadInvoice(t *testing.T) {
 		t.Fatalf("expected application/pdf, got %s", ct)
 	}
 }
+
+func TestEntriesPersistAcrossUploads(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	first := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+`
+	second := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/2/19","09:00","12:00"
+"2","150","Globex","7/2/19","10:00","15:00"
+`
+	if _, err := readCSV(strings.NewReader(first), "first.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	res, err := readCSV(strings.NewReader(second), "second.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	// acme should hold hours from both uploads
+	entries, err := loadEntries(EntryFilter{Company: "acme"})
+	if err != nil {
+		t.Fatalf("loadEntries returned error: %v", err)
+	}
+	if e := rollup(entries)["acme"][1]; e.TotalHours != 5 {
+		t.Fatalf("expected employee 1 total 5 hours, got %v", e.TotalHours)
+	}
+
+	// scoped to the second batch, acme only has the second upload's hours
+	entries, err = loadEntries(EntryFilter{Company: "acme", BatchID: res.ID})
+	if err != nil {
+		t.Fatalf("loadEntries returned error: %v", err)
+	}
+	if e := rollup(entries)["acme"][1]; e.TotalHours != 3 {
+		t.Fatalf("expected employee 1 total 3 hours in batch, got %v", e.TotalHours)
+	}
+
+	// the rolled-up view holds the hours worked per batch, company, employee and rate
+	var hours, cost float64
+	err = DB.QueryRow(`SELECT worked_hours, worked_cost FROM company_employees WHERE batch_id = ? AND company = ? AND employee_id = ?`,
+		res.ID, "acme", 1).Scan(&hours, &cost)
+	if err != nil {
+		t.Fatalf("failed to query company_employees: %v", err)
+	}
+	if hours != 3 || cost != 300 {
+		t.Fatalf("expected 3 hours costing 300 in the view, got %v hours costing %v", hours, cost)
+	}
+	var groups int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM company_employees`).Scan(&groups); err != nil {
+		t.Fatalf("failed to query company_employees: %v", err)
+	}
+	if groups != 3 {
+		t.Fatalf("expected 3 rows in the view, got %d", groups)
+	}
+
+	batches, err := listBatches()
+	if err != nil {
+		t.Fatalf("listBatches returned error: %v", err)
+	}
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+}
+
+func TestDownloadInvoice_Batch(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	b, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 1, BillableRate: 100, Company: "netflix", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 14, 0, 0, 0, time.UTC), Hours: 5},
+	})
+	if err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+
+	router := Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/batches/"+b.ID+"/download/Netflix", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/batches/unknown/download/Netflix", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown batch, got %d", rr.Code)
+	}
+}
+
+func TestGenerateInvoice_DateRange(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","6/28/19","09:00","11:00"
+"1","100","Acme","2019-07-01","09:00","12:00"
+"1","100","Acme","7/31/2019","09:00","13:00"
+"1","100","Acme","8/1/19","09:00","17:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	filter := EntryFilter{
+		Company: "acme",
+		From:    time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC),
+		To:      time.Date(2019, 7, 31, 0, 0, 0, 0, time.UTC),
+	}
+	entries, err := loadEntries(filter)
+	if err != nil {
+		t.Fatalf("loadEntries returned error: %v", err)
+	}
+
+	// only july entries (3 + 4 hours), both bounds inclusive
+	if e := rollup(entries)["acme"][1]; e.TotalHours != 7 {
+		t.Fatalf("expected employee 1 total 7 hours in july, got %v", e.TotalHours)
+	}
+
+	// open-ended period falls back to the entry dates
+	from, to := invoicePeriod(EntryFilter{From: filter.From}, entries)
+	if !from.Equal(filter.From) || !to.Equal(filter.To) {
+		t.Fatalf("expected period %v - %v, got %v - %v", filter.From, filter.To, from, to)
+	}
+
+	// no entries in the period is an error
+	_, err = generateInvoice("Acme", EntryFilter{From: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, InvoiceOptions{})
+	if err == nil {
+		t.Fatal("expected error for empty period, got nil")
+	}
+}
+
+func TestDownloadInvoice_InvalidPeriod(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/download/Acme?from=2019-07-31&to=2019-07-01", nil)
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 Bad Request, got %d", rr.Code)
+	}
+}
+
+func TestReadCSV_Overnight(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","22:00","06:00"
+"2","100","Acme","7/1/19","2019-07-01 20:00","2019-07-02 02:30"
+`
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	if e := res.Companies["acme"][1]; e.TotalHours != 8 {
+		t.Fatalf("expected employee 1 total 8 hours, got %v", e.TotalHours)
+	}
+	if e := res.Companies["acme"][2]; e.TotalHours != 6.5 {
+		t.Fatalf("expected employee 2 total 6.5 hours, got %v", e.TotalHours)
+	}
+}
+
+func TestReadCSV_NonPositiveDuration(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	tests := map[string]string{
+		"zero":     `"1","100","Acme","7/1/19","09:00","09:00"`,
+		"negative": `"1","100","Acme","7/1/19","2019-07-01 17:00","2019-07-01 09:00"`,
+	}
+
+	for name, row := range tests {
+		csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+` + row + "\n"
+		_, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+		if err == nil {
+			t.Fatalf("%s: expected error, got nil", name)
+		}
+		if !strings.Contains(err.Error(), "line 3") {
+			t.Fatalf("%s: expected error to name line 3, got %v", name, err)
+		}
+	}
+}
+
+func TestDownloadInvoice_Itemised(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"2","150","Acme","7/1/19","10:00","15:00"
+"1","100","Acme","7/2/19","12:00","14:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	router := Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/Acme?mode=itemised", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Fatalf("expected application/pdf, got %s", ct)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/Acme?mode=detailed", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown mode, got %d", rr.Code)
+	}
+}
+
+func TestReadCSV_RateChange(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"1","120","Acme","7/15/19","09:00","12:00"
+"1","100","Acme","7/16/19","09:00","10:00"
+`
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	e := res.Companies["acme"][1]
+	if len(e.Rates) != 2 {
+		t.Fatalf("expected 2 rate lines, got %d", len(e.Rates))
+	}
+	if e.Rates[0].BillableRate != 100 || e.Rates[0].Hours != 3 || e.Rates[0].Cost != 300 {
+		t.Fatalf("unexpected first rate line: %+v", e.Rates[0])
+	}
+	if e.Rates[1].BillableRate != 120 || e.Rates[1].Hours != 3 || e.Rates[1].Cost != 360 {
+		t.Fatalf("unexpected second rate line: %+v", e.Rates[1])
+	}
+
+	// cost is per entry, not total hours x first rate
+	if e.TotalHours != 6 || e.TotalCost != 660 {
+		t.Fatalf("expected 6 hours costing 660, got %v hours costing %v", e.TotalHours, e.TotalCost)
+	}
+
+	if len(res.Warnings) != 1 {
+		t.Fatalf("expected 1 rate warning, got %v", res.Warnings)
+	}
+}
+
+func TestReadCSV_HeaderMapping(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	// reordered columns with an extra notes column and alias names
+	csv := `"Date","Notes","Client","start","End Time","Rate","Employee"
+"7/1/19","kickoff","Acme","09:00","11:00","100","1"
+`
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if e := res.Companies["acme"][1]; e.TotalHours != 2 || e.TotalCost != 200 {
+		t.Fatalf("expected employee 1 with 2 hours costing 200, got %+v", e)
+	}
+
+	// explicit mapping for non-standard headers
+	csv = `"Staff #","Price","Customer","Day","Clock In","Clock Out"
+"2","150","Acme","7/1/19","10:00","15:00"
+`
+	mapping := ColumnMapping{colEmployeeID: "Staff #", colBillableRate: "price", colProject: "Customer", colStartTime: "Clock In", colEndTime: "Clock Out"}
+	res, err = readCSV(strings.NewReader(csv), "test.csv", UploadOptions{Mapping: mapping})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if e := res.Companies["acme"][2]; e.TotalHours != 5 {
+		t.Fatalf("expected employee 2 total 5 hours, got %v", e.TotalHours)
+	}
+
+	// missing required columns are named in the error
+	csv = `"Employee ID","Project","Date","Start time"
+"1","Acme","7/1/19","09:00"
+`
+	_, err = readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "billable_rate") || !strings.Contains(err.Error(), "end_time") {
+		t.Fatalf("expected missing column error naming billable_rate and end_time, got %v", err)
+	}
+}
+
+func TestUploadCSV_Profile(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	router := Router()
+
+	body := `{"Mapping": {"employee_id": "Staff #", "billable_rate": "Price", "project": "Customer", "start_time": "Clock In", "end_time": "Clock Out"}}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/profiles/payroll", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK saving profile, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.WriteField("profile", "payroll"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.CreateFormFile("file", "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := `"Staff #","Price","Customer","Date","Clock In","Clock Out"
+"1","100","Acme","7/1/19","09:00","11:00"
+`
+	if _, err := io.Copy(fw, bytes.NewBufferString(csv)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadCSV_ValidationModes(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"x","abc","Acme","7/1/19","09:00","11:00"
+"2","150","Acme","13/45/19","10:00","15:00"
+"3","150","Acme","7/1/19","10:00","10:00"
+"4","150","Acme","7/1/19","10:00","15:00"
+`
+	// strict: every problem is reported and nothing is stored
+	_, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{Mode: ModeStrict})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	expected := []RowError{
+		{Line: 3, Column: colEmployeeID},
+		{Line: 3, Column: colBillableRate},
+		{Line: 4, Column: colDate},
+		{Line: 5, Column: colEndTime},
+	}
+	if len(verr.Errors) != len(expected) {
+		t.Fatalf("expected %d problems, got %+v", len(expected), verr.Errors)
+	}
+	for i, e := range expected {
+		if verr.Errors[i].Line != e.Line || verr.Errors[i].Column != e.Column {
+			t.Errorf("problem %d: expected line %d column %s, got %+v", i, e.Line, e.Column, verr.Errors[i])
+		}
+	}
+
+	// validate: problems reported, nothing stored
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{Mode: ModeValidate})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if len(res.Rejected) != len(expected) || res.ID != "" {
+		t.Fatalf("expected %d rejected rows and no batch, got %+v", len(expected), res)
+	}
+	if batches, _ := listBatches(); len(batches) != 0 {
+		t.Fatalf("expected no batches after validation, got %d", len(batches))
+	}
+
+	// lenient: valid rows imported, invalid ones reported
+	res, err = readCSV(strings.NewReader(csv), "test.csv", UploadOptions{Mode: ModeLenient})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if res.EntryCount != 2 || len(res.Rejected) != len(expected) {
+		t.Fatalf("expected 2 entries and %d rejected rows, got %d and %d", len(expected), res.EntryCount, len(res.Rejected))
+	}
+}
+
+func TestUploadCSV_ValidationReport(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"2","abc","Acme","7/1/19","09:00","11:00"
+`
+	if _, err := io.Copy(fw, bytes.NewBufferString(csv)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Details []RowError `json:"details"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Details) != 1 || resp.Details[0].Line != 3 || resp.Details[0].Column != colBillableRate {
+		t.Fatalf("unexpected validation details: %+v", resp.Details)
+	}
+}
+
+func TestInvoiceRegister(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"2","150","Acme","7/1/19","10:00","15:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	first, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Number != invoicePrefix+"00001" || first.Total != 950 || first.TotalHours != 7 {
+		t.Fatalf("unexpected first invoice: %+v", first)
+	}
+	if !first.DueDate.Equal(first.IssueDate.AddDate(0, 0, paymentTermsDays)) {
+		t.Fatalf("expected due date %d days after issue, got %v and %v", paymentTermsDays, first.IssueDate, first.DueDate)
+	}
+
+	// drafts and failed invoices don't take a number
+	if _, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := generateInvoice("Unknown", EntryFilter{}, InvoiceOptions{}); err == nil {
+		t.Fatal("expected error for missing company, got nil")
+	}
+
+	// downloading the same invoice again returns the one already issued
+	again, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.Number != first.Number || !again.IssueDate.Equal(first.IssueDate) || !again.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("expected the issued invoice %+v again, got %+v", first.Invoice, again.Invoice)
+	}
+
+	// new entries make a new invoice
+	more := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","13:00","14:00"
+`
+	if _, err := readCSV(strings.NewReader(more), "more.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	second, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.Number != invoicePrefix+"00002" {
+		t.Fatalf("expected sequential number %s00002, got %s", invoicePrefix, second.Number)
+	}
+
+	// browser re-downloads and range requests reuse it too
+	for _, rangeHeader := range []string{"", "bytes=0-99"} {
+		req := httptest.NewRequest("GET", "/api/download/Acme", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		Router().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusPartialContent {
+			t.Fatalf("expected the invoice to download, got %d, body: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, httptest.NewRequest("GET", "/api/invoices?company=Acme", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Data []Invoice `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Data) != 2 || resp.Data[1].Number != second.Number {
+		t.Fatalf("unexpected invoice register: %+v", resp.Data)
+	}
+}
+
+func TestComputeTotals(t *testing.T) {
+	employees := EmployeeMap{
+		1: {Rates: []RateLine{{BillableRate: 100, Hours: 1.5, Cost: 150}}},
+		// 0.125 hours at 81 = 10.125, rounded half away from zero to 10.13
+		2: {Rates: []RateLine{{BillableRate: 81, Hours: 0.125, Cost: 10.125}}},
+	}
+
+	tests := []struct {
+		name     string
+		settings BillingSettings
+		want     Totals
+	}{
+		{
+			name:     "no tax or discount",
+			settings: BillingSettings{},
+			want:     Totals{Subtotal: 160.13, Total: 160.13},
+		},
+		{
+			// 12.5% of 160.13 = 20.01625 -> 20.02; taxable 140.11; 15% = 21.0165 -> 21.02
+			name: "percent discount then tax",
+			settings: BillingSettings{
+				Discount: &Discount{Type: DiscountPercent, Value: 12.5},
+				Taxes:    []Tax{{Name: "VAT", Rate: 15}},
+			},
+			want: Totals{Subtotal: 160.13, Discount: 20.02, Tax: 21.02, Total: 161.13},
+		},
+		{
+			// taxable 150.13; NHIL 2.5% = 3.75325 -> 3.75; VAT 15% on 153.88 = 23.082 -> 23.08
+			name: "fixed discount with stacked compound tax",
+			settings: BillingSettings{
+				Discount: &Discount{Type: DiscountFixed, Value: 10},
+				Taxes:    []Tax{{Name: "NHIL", Rate: 2.5}, {Name: "VAT", Rate: 15, Compound: true}},
+			},
+			want: Totals{Subtotal: 160.13, Discount: 10, Tax: 26.83, Total: 176.96},
+		},
+		{
+			name:     "fixed discount capped at subtotal",
+			settings: BillingSettings{Discount: &Discount{Type: DiscountFixed, Value: 500}},
+			want:     Totals{Subtotal: 160.13, Discount: 160.13, Total: 0},
+		},
+	}
+
+	for _, tt := range tests {
+		got := computeTotals(employees, tt.settings)
+		if got.Subtotal != tt.want.Subtotal || got.Discount != tt.want.Discount || got.Tax != tt.want.Tax || got.Total != tt.want.Total {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestBillingSettings(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	router := Router()
+
+	body := `{"Taxes": [{"Name": "VAT", "Rate": 20}], "Discount": {"Type": "percent", "Value": 10}}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/companies/Acme/billing", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/companies/Acme/billing", strings.NewReader(`{"Discount": {"Type": "bogus", "Value": 10}}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid discount, got %d", rr.Code)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	// 200 - 10% = 180, + 20% VAT = 216
+	inv, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inv.Subtotal != 200 || inv.Discount != 20 || inv.Tax != 36 || inv.Total != 216 {
+		t.Fatalf("unexpected invoice totals: %+v", inv)
+	}
+}
+
+func TestGenerateInvoice_Currency(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	if _, err := saveBillingSettings(BillingSettings{Company: "Acme", Currency: "eur"}); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+
+	rates := `Base,Quote,Rate
+EUR,USD,1.25
+EUR,GHS,12.5
+`
+	xs, err := readExchangeRates(strings.NewReader(rates))
+	if err != nil {
+		t.Fatalf("readExchangeRates returned error: %v", err)
+	}
+	if _, err := saveExchangeRates(xs); err != nil {
+		t.Fatalf("failed to save exchange rates: %v", err)
+	}
+
+	// 2h at 100 EUR, 2h at 125 USD (= 200 EUR) and 1h at 125 GHS (= 10 EUR)
+	csv := `"Employee ID","Billable Rate (per hour)","Currency","Project","Date","Start time","End Time"
+"1","100","","Acme","7/1/19","09:00","11:00"
+"2","125","USD","Acme","7/1/19","09:00","11:00"
+"3","125","ghs","Acme","7/1/19","09:00","10:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	inv, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Itemised: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inv.Currency != "EUR" || inv.Total != 410 {
+		t.Fatalf("expected total of 410 EUR, got %v %s", inv.Total, inv.Currency)
+	}
+
+	// missing exchange rates fail the invoice
+	csv = `"Employee ID","Billable Rate (per hour)","Currency","Project","Date","Start time","End Time"
+"1","100","JPY","Acme","7/2/19","09:00","11:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if _, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{}); err == nil {
+		t.Fatal("expected error for missing exchange rate, got nil")
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+		ok     bool
+	}{
+		{"", "pdf", true},
+		{"*/*", "pdf", true},
+		{"application/json", "json", true},
+		{"text/csv;q=0.5, application/xml", "ubl", true},
+		{"text/html;q=0.9, text/csv", "csv", true},
+		{"application/json, */*;q=0.1", "json", true},
+		{"text/html", "html", true},
+		// browsers send text/html first when following a download link
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8", "pdf", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7", "pdf", true},
+		{"text/html, application/pdf;q=0.5, */*;q=0.1", "html", true},
+		{"image/png", "", false},
+		{"application/json;q=0", "", false},
+	}
+
+	for _, tt := range tests {
+		format, ok := negotiateFormat(tt.accept)
+		if format != tt.format || ok != tt.ok {
+			t.Errorf("negotiateFormat(%q) = %q, %v, want %q, %v", tt.accept, format, ok, tt.format, tt.ok)
+		}
+	}
+}
+
+func TestDownloadInvoice_Formats(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	if _, err := saveBillingSettings(BillingSettings{Company: "Acme", Currency: "USD", Taxes: []Tax{{Name: "VAT", Rate: 10}}}); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+	_, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 2, BillableRate: 50, Company: "acme", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 11, 0, 0, 0, time.UTC), Hours: 2},
+		{EmployeeID: 1, BillableRate: 100, Company: "acme", Date: time.Date(2019, 7, 2, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 2, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 2, 10, 0, 0, 0, time.UTC), Hours: 1},
+	})
+	if err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+
+	tests := []struct {
+		query       string
+		accept      string
+		contentType string
+		contains    string
+	}{
+		{"?draft=true", "", "application/pdf", "%PDF"},
+		{"?draft=true&format=html", "", "text/html; charset=utf-8", "<td>$200.00</td>"},
+		{"?draft=true&format=csv", "application/json", "text/csv", "DRAFT,total,Total (USD),,,,,,,,,,,,,220.00,USD"},
+		{"?draft=true", "application/json", "application/json", `"Total": 220`},
+		{"?draft=true", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8", "application/pdf", "%PDF"},
+		{"?draft=true&format=xml", "", "application/xml", `<cbc:PayableAmount currencyID="USD">220.00</cbc:PayableAmount>`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/download/Acme"+tt.query, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rr := httptest.NewRecorder()
+		Router().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 OK, got %d, body: %s", tt.query, rr.Code, rr.Body.String())
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: expected %s, got %s", tt.query, tt.contentType, ct)
+		}
+		if !strings.Contains(rr.Body.String(), tt.contains) {
+			t.Errorf("%s: expected body to contain %q, got:\n%s", tt.query, tt.contains, rr.Body.String())
+		}
+	}
+
+	// the JSON model lists lines in employee order
+	req := httptest.NewRequest("GET", "/api/download/Acme?draft=true&format=json", nil)
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	var doc InvoiceDocument
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to decode invoice: %v", err)
+	}
+	if len(doc.Lines) != 2 || doc.Lines[0].EmployeeID != 1 || doc.Lines[1].Cost != 100 {
+		t.Fatalf("unexpected invoice lines: %+v", doc.Lines)
+	}
+
+	// the UBL invoice is well-formed XML
+	req = httptest.NewRequest("GET", "/api/download/Acme?draft=true&format=ubl", nil)
+	rr = httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	var ubl struct {
+		ID    string   `xml:"ID"`
+		Lines []string `xml:"InvoiceLine>ID"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &ubl); err != nil {
+		t.Fatalf("failed to parse UBL invoice: %v", err)
+	}
+	if ubl.ID != "DRAFT" || len(ubl.Lines) != 2 {
+		t.Fatalf("unexpected UBL invoice: %+v", ubl)
+	}
+
+	// unknown formats are rejected
+	for _, tt := range []struct {
+		query, accept string
+		code          int
+	}{
+		{"?format=docx", "", 400},
+		{"", "image/png", 406},
+	} {
+		req := httptest.NewRequest("GET", "/api/download/Acme"+tt.query, nil)
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		Router().ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("%q %q: expected %d, got %d", tt.query, tt.accept, tt.code, rr.Code)
+		}
+	}
+}
+
+func TestExportInvoices(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	_, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 1, BillableRate: 100, Company: "acme", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 11, 0, 0, 0, time.UTC), Hours: 2},
+		{EmployeeID: 2, BillableRate: 50, Company: "globex", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 10, 0, 0, 0, time.UTC), Hours: 1},
+		{EmployeeID: 3, BillableRate: 80, Company: "initech", Date: time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 8, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 8, 1, 10, 0, 0, 0, time.UTC), Hours: 1},
+	})
+	if err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+
+	// every company with entries in July
+	req := httptest.NewRequest("GET", "/api/download?to=2019-07-31", nil)
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("expected application/zip, got %s", ct)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to open export: %v", err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"acme_invoice.pdf", "globex_invoice.pdf", "manifest.csv"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected files %v, got %v", want, names)
+	}
+
+	f, err := archive.Open("manifest.csv")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	manifest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if !strings.Contains(string(manifest), "acme,INV-00001,acme_invoice.pdf,2019-07-01,2019-07-31,USD,2.00,200.00") ||
+		!strings.Contains(string(manifest), "globex,INV-00002,globex_invoice.pdf") {
+		t.Fatalf("unexpected manifest:\n%s", manifest)
+	}
+
+	// a chosen subset; an unknown company fails the export without numbering anything
+	req = httptest.NewRequest("GET", "/api/download?company=Initech&company=Acme,Nobody&draft=true", nil)
+	rr = httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != 400 {
+		t.Fatalf("expected 400 for unknown company, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/download?company=Initech&format=json", nil)
+	rr = httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	archive, err = zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to open export: %v", err)
+	}
+	if len(archive.File) != 2 || archive.File[0].Name != "initech_invoice.json" {
+		t.Fatalf("unexpected export contents: %v", archive.File)
+	}
+
+	invs, err := listInvoices("")
+	if err != nil {
+		t.Fatalf("failed to list invoices: %v", err)
+	}
+	if len(invs) != 3 || invs[2].Number != "INV-00003" {
+		t.Fatalf("expected 3 gap-free invoices, got %+v", invs)
+	}
+}
+
+func TestExportInvoices_FileNames(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	day := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	var entries []TimeEntry
+	for i, company := range []string{"a b", "a_b", "acme inc.", "acme inc"} {
+		entries = append(entries, TimeEntry{EmployeeID: 1, BillableRate: float64(100 * (i + 1)), Company: company, Date: day,
+			Start: day.Add(9 * time.Hour), End: day.Add(10 * time.Hour), Hours: 1})
+	}
+	if _, err := saveBatch("test.csv", entries); err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/download?format=json&draft=true", nil)
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to open export: %v", err)
+	}
+
+	// every company has its own file, and the manifest names the file holding its invoice
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		if files[f.Name] != nil {
+			t.Fatalf("duplicate file %s in export", f.Name)
+		}
+		files[f.Name] = f
+	}
+	if len(files) != 5 {
+		t.Fatalf("expected 4 invoices and a manifest, got %v", archive.File)
+	}
+	read := func(name string) []byte {
+		t.Helper()
+		f, ok := files[name]
+		if !ok {
+			t.Fatalf("export has no file %s", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		return b
+	}
+	manifest, err := csv.NewReader(bytes.NewReader(read(exportManifest))).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	for _, row := range manifest[1:] {
+		var doc InvoiceDocument
+		if err := json.Unmarshal(read(row[2]), &doc); err != nil {
+			t.Fatalf("failed to decode %s: %v", row[2], err)
+		}
+		if doc.Company != row[0] {
+			t.Errorf("manifest lists %s in %s, which holds the invoice for %s", row[0], row[2], doc.Company)
+		}
+	}
+}
+
+func TestInvoiceStorage(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	invoiceStorageDir = t.TempDir()
+	invoiceRetentionCount = 2
+	defer func() { invoiceStorageDir, invoiceRetentionCount, invoiceRetentionDays = "", 0, 0 }()
+
+	_, err := saveBatch("test.csv", []TimeEntry{
+		{EmployeeID: 1, BillableRate: 100, Company: "acme", Date: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), Start: time.Date(2019, 7, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2019, 7, 1, 11, 0, 0, 0, time.UTC), Hours: 2},
+	})
+	if err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+
+	stored := func() []string {
+		dirEntries, err := os.ReadDir(invoiceStorageDir)
+		if err != nil {
+			t.Fatalf("failed to read storage: %v", err)
+		}
+		var names []string
+		for _, d := range dirEntries {
+			names = append(names, d.Name())
+		}
+		return names
+	}
+
+	// issued invoices are kept under their number, drafts are not kept
+	for i := 0; i < 3; i++ {
+		period := EntryFilter{To: time.Date(2019, 7, 1+i, 0, 0, 0, 0, time.UTC)}
+		if _, err := generateInvoice("Acme", period, InvoiceOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// distinct modification times for the retention order
+		name := fmt.Sprintf("%s%05d_acme_invoice.pdf", invoicePrefix, i+1)
+		past := time.Now().Add(time.Duration(i-3) * 10 * time.Hour)
+		if err := os.Chtimes(filepath.Join(invoiceStorageDir, name), past, past); err != nil {
+			t.Fatalf("failed to age %s: %v", name, err)
+		}
+	}
+	if _, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the retention count keeps the newest two
+	if err := pruneInvoices(time.Now()); err != nil {
+		t.Fatalf("pruneInvoices returned error: %v", err)
+	}
+	want := []string{invoicePrefix + "00002_acme_invoice.pdf", invoicePrefix + "00003_acme_invoice.pdf"}
+	if got := stored(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected stored invoices %v, got %v", want, got)
+	}
+
+	// files older than the retention period are removed
+	invoiceRetentionCount, invoiceRetentionDays = 0, 1
+	if err := pruneInvoices(time.Now().Add(5 * time.Hour)); err != nil {
+		t.Fatalf("pruneInvoices returned error: %v", err)
+	}
+	if got := stored(); len(got) != 1 || got[0] != want[1] {
+		t.Fatalf("expected only %s to be kept, got %v", want[1], got)
+	}
+}
+
+func TestApplyRounding(t *testing.T) {
+	day := func(d, h, m int) time.Time { return time.Date(2019, 7, d, h, m, 0, 0, time.UTC) }
+	entry := func(d, startH, startM, endH, endM int) TimeEntry {
+		start, end := day(d, startH, startM), day(d, endH, endM)
+		return TimeEntry{EmployeeID: 1, Company: "acme", Date: day(d, 0, 0), Start: start, End: end, Hours: end.Sub(start).Hours()}
+	}
+
+	tests := []struct {
+		name   string
+		policy *RoundingPolicy
+		want   []float64
+	}{
+		{"exact", nil, []float64{1.1, 0.25, 2}},
+		{"up to 15 minutes", &RoundingPolicy{Increment: 15, Direction: RoundUp}, []float64{1.25, 0.25, 2}},
+		{"down to 15 minutes", &RoundingPolicy{Increment: 15, Direction: RoundDown}, []float64{1, 0.25, 2}},
+		{"nearest 30 minutes", &RoundingPolicy{Increment: 30, Direction: RoundNearest}, []float64{1, 0.5, 2}},
+		{"1 hour minimum per entry", &RoundingPolicy{MinimumEntry: 60}, []float64{1.1, 1, 2}},
+		// day 1 bills 1.35h, topped up to 4h on its last entry
+		{"4 hour minimum per day", &RoundingPolicy{MinimumDay: 240}, []float64{1.1, 2.9, 4}},
+	}
+
+	for _, tt := range tests {
+		entries := []TimeEntry{entry(1, 9, 0, 10, 6), entry(1, 13, 0, 13, 15), entry(2, 9, 0, 11, 0)}
+		applyRounding(entries, tt.policy)
+		for i, e := range entries {
+			if math.Abs(e.BilledHours-tt.want[i]) > 1e-9 {
+				t.Errorf("%s: entry %d billed %v hours, want %v", tt.name, i, e.BilledHours, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestGenerateInvoice_Rounding(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	invalid := BillingSettings{Company: "Acme", Rounding: &RoundingPolicy{Increment: 15, Direction: "sideways"}}
+	if _, err := saveBillingSettings(invalid); err == nil {
+		t.Fatal("expected error for invalid rounding direction, got nil")
+	}
+	policy := BillingSettings{Company: "Acme", Rounding: &RoundingPolicy{Increment: 15, Direction: RoundUp, MinimumEntry: 60}}
+	if _, err := saveBillingSettings(policy); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+
+	// 1h05 rounds up to 1h15, 20 minutes is raised to the 1 hour minimum
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","10:05"
+"1","100","Acme","7/1/19","11:00","11:20"
+"2","100","Globex","7/1/19","11:00","11:20"
+`
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if emp := res.Companies["acme"][1]; emp.TotalHours != 2.25 || emp.TotalCost != 225 {
+		t.Fatalf("expected 2.25 billed hours costing 225, got %+v", emp)
+	}
+	if emp := res.Companies["globex"][2]; math.Abs(emp.TotalHours-1.0/3) > 1e-9 {
+		t.Fatalf("expected companies without a policy to bill exact time, got %+v", emp)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Itemised: true, Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc InvoiceDocument
+	if err := json.Unmarshal(out.Content, &doc); err != nil {
+		t.Fatalf("failed to decode invoice: %v", err)
+	}
+	if !doc.Rounded || doc.TotalHours != 2.25 || doc.Total != 225 {
+		t.Fatalf("unexpected invoice hours or total: %+v", doc.Invoice)
+	}
+	if math.Abs(doc.RawHours-(65.0+20.0)/60) > 1e-9 {
+		t.Fatalf("expected %v raw hours, got %v", (65.0+20.0)/60, doc.RawHours)
+	}
+	if e := doc.Groups[0].Entries[1]; e.Hours != 1 || math.Abs(e.RawHours-20.0/60) > 1e-9 || e.Cost != 100 {
+		t.Fatalf("unexpected itemised entry: %+v", e)
+	}
+}
+
+func TestApplyOvertime(t *testing.T) {
+	// 2019-07-01 is a Monday
+	entry := func(d, startH, endH int) TimeEntry {
+		start, end := time.Date(2019, 7, d, startH, 0, 0, 0, time.UTC), time.Date(2019, 7, d, endH, 0, 0, 0, time.UTC)
+		hours := end.Sub(start).Hours()
+		return TimeEntry{EmployeeID: 1, Company: "acme", Date: time.Date(2019, 7, d, 0, 0, 0, 0, time.UTC), Start: start, End: end, Hours: hours, BilledHours: hours}
+	}
+	// Monday to Friday 10h a day, then 4h on Saturday
+	var entries []TimeEntry
+	for d := 1; d <= 5; d++ {
+		entries = append(entries, entry(d, 8, 18))
+	}
+	entries = append(entries, entry(6, 9, 13))
+
+	applyOvertime(entries, &OvertimePolicy{DailyThreshold: 8, DailyMultiplier: 1.5, WeeklyThreshold: 36, WeeklyMultiplier: 1.5, WeekendMultiplier: 2})
+
+	// 8 regular hours a day count towards the week, until Friday passes 36
+	want := [][]PremiumHours{
+		{{PremiumDaily, 1.5, 2}},
+		{{PremiumDaily, 1.5, 2}},
+		{{PremiumDaily, 1.5, 2}},
+		{{PremiumDaily, 1.5, 2}},
+		{{PremiumDaily, 1.5, 2}, {PremiumWeekly, 1.5, 4}},
+		{{PremiumWeekend, 2, 4}},
+	}
+	for i, e := range entries {
+		if !reflect.DeepEqual(e.Premiums, want[i]) {
+			t.Errorf("entry %d: expected premiums %+v, got %+v", i, want[i], e.Premiums)
+		}
+	}
+	if portions := entryPortions(entries[4]); len(portions) != 3 || portions[0].Hours != 4 || portions[0].Multiplier != 1 {
+		t.Errorf("expected 4 regular hours before the premiums, got %+v", portions)
+	}
+	if portions := entryPortions(entries[5]); len(portions) != 1 || portions[0].Kind != PremiumWeekend {
+		t.Errorf("expected weekend entries to have no regular hours, got %+v", portions)
+	}
+
+	applyOvertime(entries, nil)
+	for i, e := range entries {
+		if e.Premiums != nil {
+			t.Errorf("entry %d: expected no premiums without a policy, got %+v", i, e.Premiums)
+		}
+	}
+}
+
+func TestGenerateInvoice_Overtime(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	invalid := BillingSettings{Company: "Acme", Overtime: &OvertimePolicy{DailyThreshold: 8}}
+	if _, err := saveBillingSettings(invalid); err == nil {
+		t.Fatal("expected error for a daily threshold without a multiplier, got nil")
+	}
+	policy := BillingSettings{Company: "Acme", Overtime: &OvertimePolicy{DailyThreshold: 8, DailyMultiplier: 1.5}}
+	if _, err := saveBillingSettings(policy); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+
+	// 10 hours in two shifts: the last 2 hours are overtime
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","08:00","12:00"
+"1","100","Acme","7/1/19","13:00","19:00"
+`
+	res, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if emp := res.Companies["acme"][1]; emp.TotalHours != 10 || emp.TotalCost != 1100 {
+		t.Fatalf("expected 10 hours costing 1100, got %+v", emp)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc InvoiceDocument
+	if err := json.Unmarshal(out.Content, &doc); err != nil {
+		t.Fatalf("failed to decode invoice: %v", err)
+	}
+	if !doc.Premiums || len(doc.Lines) != 2 || doc.Total != 1100 {
+		t.Fatalf("expected a regular and an overtime line totalling 1100, got %+v", doc)
+	}
+	if l := doc.Lines[0]; l.Type != "Regular" || l.Hours != 8 || l.Cost != 800 {
+		t.Fatalf("unexpected regular line: %+v", l)
+	}
+	if l := doc.Lines[1]; l.Type != "Overtime ×1.5" || l.Hours != 2 || l.UnitPrice != 150 || l.Cost != 300 {
+		t.Fatalf("unexpected overtime line: %+v", l)
+	}
+}
+
+func TestGenerateInvoice_OvertimeAcrossPeriods(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+	policy := BillingSettings{Company: "Acme", Overtime: &OvertimePolicy{WeeklyThreshold: 40, WeeklyMultiplier: 1.5}}
+	if _, err := saveBillingSettings(policy); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+
+	// 50 hours in the ISO week of Monday 29 July to Sunday 4 August: the last 10 are overtime,
+	// and they fall in August. The week is uploaded in two batches, split at the month.
+	const header = "Employee ID,Rate,Project,Date,Start,End\n"
+	july, err := readCSV(strings.NewReader(header+
+		"1,100,Acme,2019-07-29,08:00,18:00\n1,100,Acme,2019-07-30,08:00,18:00\n1,100,Acme,2019-07-31,08:00,18:00\n"), "july.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	august, err := readCSV(strings.NewReader(header+
+		"1,100,Acme,2019-08-01,08:00,18:00\n1,100,Acme,2019-08-02,08:00,18:00\n"), "august.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	total := func(filter EntryFilter) float64 {
+		t.Helper()
+		out, err := generateInvoice("Acme", filter, InvoiceOptions{Format: "json", Draft: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var doc InvoiceDocument
+		if err := json.Unmarshal(out.Content, &doc); err != nil {
+			t.Fatalf("failed to decode invoice: %v", err)
+		}
+		return doc.Total
+	}
+
+	day := func(s string) time.Time {
+		d, _ := time.Parse(dateLayout, s)
+		return d
+	}
+	tests := []struct {
+		name   string
+		filter EntryFilter
+		total  float64
+	}{
+		{"whole week", EntryFilter{}, 5500},
+		{"july", EntryFilter{From: day("2019-07-01"), To: day("2019-07-31")}, 3000},
+		{"august", EntryFilter{From: day("2019-08-01"), To: day("2019-08-31")}, 2500},
+		// a batch is billed from its own entries only: august.csv holds 20 hours of the week
+		{"july batch", EntryFilter{BatchID: july.ID}, 3000},
+		{"august batch", EntryFilter{BatchID: august.ID}, 2000},
+	}
+	for _, tt := range tests {
+		if got := total(tt.filter); got != tt.total {
+			t.Errorf("%s: expected a total of %v, got %v", tt.name, tt.total, got)
+		}
+	}
+}
+
+func TestGenerateInvoice_OverlappingBatches(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+	policy := BillingSettings{Company: "Acme", Overtime: &OvertimePolicy{WeeklyThreshold: 40, WeeklyMultiplier: 1.5}}
+	if _, err := saveBillingSettings(policy); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+
+	// the same 40 hour week uploaded twice: neither batch reaches overtime on its own
+	const week = "Employee ID,Rate,Project,Date,Start,End\n" +
+		"1,100,Acme,2019-07-01,09:00,17:00\n1,100,Acme,2019-07-02,09:00,17:00\n1,100,Acme,2019-07-03,09:00,17:00\n" +
+		"1,100,Acme,2019-07-04,09:00,17:00\n1,100,Acme,2019-07-05,09:00,17:00\n"
+	for _, name := range []string{"a.csv", "b.csv"} {
+		res, err := readCSV(strings.NewReader(week), name, UploadOptions{})
+		if err != nil {
+			t.Fatalf("readCSV returned error: %v", err)
+		}
+		summary := res.Companies["acme"][1].TotalCost
+		if summary != 4000 {
+			t.Errorf("%s: expected an upload summary of 4000, got %v", name, summary)
+		}
+
+		out, err := generateInvoice("Acme", EntryFilter{BatchID: res.ID}, InvoiceOptions{Format: "json", Draft: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var doc InvoiceDocument
+		if err := json.Unmarshal(out.Content, &doc); err != nil {
+			t.Fatalf("failed to decode invoice: %v", err)
+		}
+		if doc.Total != summary {
+			t.Errorf("%s: expected the batch invoice to match its upload summary of %v, got %v", name, summary, doc.Total)
+		}
+	}
+}
+
+func TestEmployeeDirectory(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	router := Router()
+
+	body := `{"Name": "Ada Lovelace", "Role": "Engineer", "DefaultRate": 100, "Currency": "usd"}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/employees/1", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/employees/2", strings.NewReader(`{"Role": "Designer"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an employee without a name, got %d", rr.Code)
+	}
+
+	staff, err := readStaff(strings.NewReader(`Employee ID,Name,Role,Default Rate,Currency
+2,Grace Hopper,,,
+3,Temp
+`))
+	if err != nil {
+		t.Fatalf("readStaff returned error: %v", err)
+	}
+	if _, err := saveStaff(staff); err != nil {
+		t.Fatalf("failed to save employees: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/employees/3", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK deleting employee, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/employees/3", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted employee, got %d", rr.Code)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"2","100","Acme","7/1/19","09:00","10:00"
+"3","100","Acme","7/1/19","09:00","10:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc InvoiceDocument
+	if err := json.Unmarshal(out.Content, &doc); err != nil {
+		t.Fatalf("failed to decode invoice: %v", err)
+	}
+	if l := doc.Lines[0]; l.EmployeeName != "Ada Lovelace" || l.EmployeeRole != "Engineer" {
+		t.Fatalf("expected employee 1 to be named from the directory, got %+v", l)
+	}
+	if !reflect.DeepEqual(doc.UnknownEmployees, []int{3}) {
+		t.Fatalf("expected employee 3 to be flagged as unknown, got %v", doc.UnknownEmployees)
+	}
+
+	out, err = generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Format: "html"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"<td>Ada Lovelace</td><td>Engineer</td>", "<td>Grace Hopper</td><td></td>", "<td>Employee 3 *</td>", "Not in the employee directory: employee ID 3"} {
+		if !strings.Contains(string(out.Content), want) {
+			t.Errorf("expected HTML invoice to contain %q", want)
+		}
+	}
+}
+
+func TestClientDirectory(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	router := Router()
+
+	body := `{"Name": "Acme", "LegalName": "Acme Corporation Ltd", "Address": "1 Main Street\nSpringfield", "TaxID": "GB123", "Email": "ap@acme.test", "PaymentTermsDays": 14, "PONumber": "PO-42"}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	var created struct{ Data Client }
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	id := created.Data.ID
+	if id == "" {
+		t.Fatal("expected the client to be given an id")
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/clients", strings.NewReader(`{"Name": "ACME"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a duplicate client name, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/clients/acme", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected client to be found by name, got %d", rr.Code)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	// invoices resolve the client by its stable id
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/"+id+"?draft=true&format=json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	var doc InvoiceDocument
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to decode invoice: %v", err)
+	}
+	if doc.Company != "acme" || doc.CompanyName != "Acme Corporation Ltd" || doc.Client == nil || doc.Total != 200 {
+		t.Fatalf("unexpected invoice for client: %+v", doc.Invoice)
+	}
+	if days := doc.DueDate.Sub(doc.IssueDate).Hours() / 24; days != 14 {
+		t.Fatalf("expected the client's 14 day payment terms, got %v days", days)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Format: "html"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"<dd>PO-42</dd>", "Acme Corporation Ltd<br>", "1 Main Street<br>", "Tax ID: GB123", "ap@acme.test"} {
+		if !strings.Contains(string(out.Content), want) {
+			t.Errorf("expected HTML invoice to contain %q", want)
+		}
+	}
+
+	out, err = generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Format: "ubl"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"<cac:OrderReference>", "<cbc:RegistrationName>Acme Corporation Ltd</cbc:RegistrationName>", "<cbc:CompanyID>GB123</cbc:CompanyID>"} {
+		if !strings.Contains(string(out.Content), want) {
+			t.Errorf("expected UBL invoice to contain %q", want)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/clients/"+id, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK deleting client, got %d", rr.Code)
+	}
+	if _, err := generateInvoice(id, EntryFilter{}, InvoiceOptions{Draft: true}); err == nil {
+		t.Fatal("expected an unknown client id to fail, got nil")
+	}
+}
+
+func TestClientRename(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+	router := Router()
+
+	c, err := saveClient(Client{Name: "Acme"})
+	if err != nil {
+		t.Fatalf("saveClient returned error: %v", err)
+	}
+	// every entry is billed at least two hours
+	policy := BillingSettings{Company: "Acme", Currency: "EUR", Rounding: &RoundingPolicy{MinimumEntry: 120}}
+	if _, err := saveBillingSettings(policy); err != nil {
+		t.Fatalf("failed to save billing settings: %v", err)
+	}
+	const header = "Employee ID,Rate,Project,Date,Start,End\n"
+	if _, err := readCSV(strings.NewReader(header+"1,100,Acme,2019-07-01,09:00,11:00\n"), "before.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/clients/"+c.ID, strings.NewReader(`{"Name": "Acme Corporation"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK renaming the client, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	// uploads under the new name and the old one are both the client's, and follow its settings
+	res, err := readCSV(strings.NewReader(header+"1,100,Acme Corporation,2019-07-02,09:00,10:00\n1,100,ACME,2019-07-03,09:00,10:00\n"),
+		"after.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	for _, name := range []string{"acme corporation", "acme"} {
+		if e := res.Companies[name][1]; e.TotalHours != 2 || e.RawHours != 1 {
+			t.Errorf("%s: expected the hour worked to be billed as 2 in the upload summary, got %+v", name, e)
+		}
+	}
+
+	for _, ref := range []string{c.ID, "acme corporation", "acme"} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/"+url.PathEscape(ref)+"?format=json&draft=true", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 OK after the rename, got %d, body: %s", ref, rr.Code, rr.Body.String())
+		}
+		var doc InvoiceDocument
+		if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("%s: failed to decode invoice: %v", ref, err)
+		}
+		if doc.CompanyName != "Acme Corporation" || doc.TotalHours != 6 || doc.Currency != "EUR" {
+			t.Errorf("%s: expected 6 hours billed in EUR to Acme Corporation, got %s, %v and %s", ref, doc.CompanyName, doc.TotalHours, doc.Currency)
+		}
+	}
+
+	// the former name stays taken
+	if _, err := saveClient(Client{Name: "acme"}); err == nil {
+		t.Error("expected a new client under the former name to be rejected")
+	}
+}
+
+func TestInvoiceTemplates(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	router := Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/templates/brand", strings.NewReader(`{"AccentColor": "blue"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid colour, got %d", rr.Code)
+	}
+
+	body := `{"Font": "Times", "AccentColor": "#112233", "Columns": ["employee", "hours", "cost"], "Footer": "Bank: 12-34-56 12345678\nPayable within 14 days", "PaperSize": "Letter"}`
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/templates/brand", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	// upload a 1x1 PNG logo
+	var logo bytes.Buffer
+	if err := png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", "logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(fw, &logo); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	req := httptest.NewRequest("POST", "/api/templates/brand/logo", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK uploading logo, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	if _, err := saveClient(Client{Name: "Globex", Template: "missing"}); err == nil {
+		t.Fatal("expected error for a client with an unknown template, got nil")
+	}
+	if _, err := saveClient(Client{Name: "Acme", Template: "brand"}); err != nil {
+		t.Fatalf("failed to save client: %v", err)
+	}
+
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"1","100","Acme","7/1/19","09:00","11:00"
+"1","100","Globex","7/1/19","09:00","11:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Format: "html"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	html := string(out.Content)
+	for _, want := range []string{
+		"<th>Employee</th><th>Number of Hours</th><th>Cost</th>",
+		"background: #112233",
+		"font-family: 'Times New Roman', Times, serif",
+		"size: letter",
+		`<img src="data:image/png;base64,`,
+		"Bank: 12-34-56 12345678<br>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected branded HTML invoice to contain %q", want)
+		}
+	}
+
+	// Letter paper is 612 x 792 points
+	out, err = generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(out.Content, []byte("/MediaBox [0 0 612.00 792.00]")) {
+		t.Error("expected a Letter sized PDF")
+	}
+
+	// companies without a template keep the default layout
+	out, err = generateInvoice("Globex", EntryFilter{}, InvoiceOptions{Draft: true, Format: "html"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(out.Content), "<th>Employee</th><th>Number of Hours</th><th>Unit Price</th><th>Cost</th>") {
+		t.Error("expected the default columns without a template")
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/templates/brand", nil))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting a template in use, got %d", rr.Code)
+	}
+}
+
+// pdfPages returns the text drawn on each page of a PDF, inflating its content streams
+func pdfPages(t *testing.T, content []byte) []string {
+	t.Helper()
+	var pages []string
+	re := regexp.MustCompile(`(?s)/Filter /FlateDecode /Length \d+>>\nstream\n(.*?)\nendstream`)
+	for _, m := range re.FindAllSubmatch(content, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(m[1]))
+		if err != nil {
+			continue // not a page, e.g. an image
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			continue
+		}
+		var text strings.Builder
+		unescape := strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`)
+		for _, s := range regexp.MustCompile(`\(((?:\\.|[^\\)])*)\) ?Tj`).FindAllSubmatch(data, -1) {
+			text.WriteString(unescape.Replace(string(s[1])))
+			text.WriteString("\n")
+		}
+		if text.Len() > 0 {
+			pages = append(pages, text.String())
+		}
+	}
+	return pages
+}
+
+func TestGenerateInvoice_Pagination(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	// 90 one hour entries at 10 each: far more than fits on a page
+	var csv strings.Builder
+	csv.WriteString(`"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"` + "\n")
+	for i := 0; i < 90; i++ {
+		fmt.Fprintf(&csv, "\"1\",\"10\",\"Acme\",\"7/%d/19\",\"%02d:00\",\"%02d:00\"\n", i/9+1, 8+i%9, 9+i%9)
+	}
+	if _, err := readCSV(strings.NewReader(csv.String()), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	out, err := generateInvoice("Acme", EntryFilter{}, InvoiceOptions{Draft: true, Itemised: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pages := pdfPages(t, out.Content)
+	if len(pages) < 2 {
+		t.Fatalf("expected several pages, got %d", len(pages))
+	}
+
+	var carried []string
+	for i, page := range pages {
+		if !strings.Contains(page, "Date\nStart\nEnd\nHours\nRate\nCost\n") {
+			t.Errorf("page %d: expected the table header", i+1)
+		}
+		if want := fmt.Sprintf("Page %d of %d", i+1, len(pages)); !strings.Contains(page, want) {
+			t.Errorf("page %d: expected %q", i+1, want)
+		}
+		if i > 0 && !strings.Contains(page, "(continued)") {
+			t.Errorf("page %d: expected the continuation heading", i+1)
+		}
+
+		if m := regexp.MustCompile(`Carried forward\n(.*)\n`).FindStringSubmatch(page); m != nil {
+			carried = append(carried, m[1])
+		} else if i < len(pages)-1 {
+			t.Errorf("page %d: expected the subtotal to be carried forward", i+1)
+		}
+		if i > 0 && !strings.Contains(page, "Brought forward\n"+carried[i-1]+"\n") {
+			t.Errorf("page %d: expected %s brought forward", i+1, carried[i-1])
+		}
+	}
+	if last := pages[len(pages)-1]; !strings.Contains(last, "Total (USD)\n$900.00\n") {
+		t.Errorf("expected the totals on the last page, got:\n%s", last)
+	}
+	// the first page carries every entry it lists
+	rows := strings.Count(pages[0], "$10.00\n") / 2
+	if want := fmt.Sprintf("$%d.00", rows*10); carried[0] != want {
+		t.Errorf("expected %s carried forward from the first page, got %s", want, carried[0])
+	}
+}
+
+func TestGenerateInvoice_Ordering(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	staff, err := readStaff(strings.NewReader(`Employee ID,Name,Role,Default Rate,Currency
+1,Ada Lovelace,Engineer,,
+2,Grace Hopper,Designer,,
+3,Zed,Engineer,,
+`))
+	if err != nil {
+		t.Fatalf("readStaff returned error: %v", err)
+	}
+	if _, err := saveStaff(staff); err != nil {
+		t.Fatalf("failed to save employees: %v", err)
+	}
+
+	// employee 1 works 2 hours, uploaded out of order; employee 4 is not in the directory
+	csv := `"Employee ID","Billable Rate (per hour)","Project","Date","Start time","End Time"
+"4","100","Acme","7/1/19","09:00","13:00"
+"1","100","Acme","7/1/19","13:00","14:00"
+"3","100","Acme","7/1/19","09:00","10:00"
+"2","100","Acme","7/1/19","09:00","12:00"
+"1","100","Acme","7/1/19","09:00","10:00"
+`
+	if _, err := readCSV(strings.NewReader(csv), "test.csv", UploadOptions{}); err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	lineIDs := func(doc InvoiceDocument) []int {
+		var ids []int
+		for _, l := range doc.Lines {
+			ids = append(ids, l.EmployeeID)
+		}
+		return ids
+	}
+	tests := []struct {
+		opts InvoiceOptions
+		want []int
+	}{
+		{InvoiceOptions{}, []int{1, 2, 3, 4}},
+		{InvoiceOptions{Order: OrderDesc}, []int{4, 3, 2, 1}},
+		{InvoiceOptions{SortBy: SortByName}, []int{1, 4, 2, 3}},
+		{InvoiceOptions{SortBy: SortByHours}, []int{4, 2, 1, 3}},
+		{InvoiceOptions{SortBy: SortByCost, Order: OrderAsc}, []int{3, 1, 2, 4}},
+		{InvoiceOptions{GroupBy: GroupByRole}, []int{2, 1, 3, 4}},
+		{InvoiceOptions{GroupBy: GroupByRole, SortBy: SortByHours, Order: OrderAsc}, []int{2, 3, 1, 4}},
+	}
+	for _, tt := range tests {
+		doc, err := buildInvoice("Acme", EntryFilter{}, tt.opts)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tt.opts, err)
+		}
+		if got := lineIDs(doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: expected employees %v, got %v", tt.opts, tt.want, got)
+		}
+	}
+
+	// itemised entries are in start time order, whatever the upload order
+	doc, err := buildInvoice("Acme", EntryFilter{}, InvoiceOptions{Itemised: true, GroupBy: GroupByRole})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g := doc.Groups[1]; g.EmployeeID != 1 || g.Entries[0].Start.Hour() != 9 || g.Entries[1].Start.Hour() != 13 {
+		t.Fatalf("expected employee 1's entries in start time order, got %+v", g)
+	}
+	want := []InvoiceSection{
+		{Name: "Designer", Hours: 3, RawHours: 3, Cost: 300},
+		{Name: "Engineer", Hours: 3, RawHours: 3, Cost: 300},
+		{Name: noRole, Hours: 4, RawHours: 4, Cost: 400},
+	}
+	if !reflect.DeepEqual(doc.Sections, want) {
+		t.Fatalf("expected sections %+v, got %+v", want, doc.Sections)
+	}
+
+	// each section is headed and closed with its subtotal
+	doc, err = buildInvoice("Acme", EntryFilter{}, InvoiceOptions{GroupBy: GroupByRole})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var kinds []string
+	for _, row := range layoutTable(doc).Rows {
+		kinds = append(kinds, row.Kind)
+	}
+	wantKinds := []string{
+		RowSection, RowLine, RowSectionSubtotal,
+		RowSection, RowLine, RowLine, RowSectionSubtotal,
+		RowSection, RowLine, RowSectionSubtotal,
+	}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Fatalf("expected rows %v, got %v", wantKinds, kinds)
+	}
+
+	// the same data gives the same document
+	router := Router()
+	var first string
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/Acme?format=html&draft=true&mode=itemised&group=role&sort=cost", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
+		}
+		if i == 0 {
+			first = rr.Body.String()
+		} else if rr.Body.String() != first {
+			t.Fatalf("expected every download to be identical")
+		}
+	}
+	if !strings.Contains(first, `<tr class="section"><td colspan="6">Designer</td></tr>`) {
+		t.Errorf("expected a section heading in the HTML invoice")
+	}
+
+	for _, query := range []string{"sort=rate", "order=up", "group=project"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/download/Acme?draft=true&"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+func TestUploadXLSX(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	// a notes sheet first, then the timesheet below a blank row, mixing native and text cells
+	book := excelize.NewFile()
+	if err := book.SetSheetName("Sheet1", "Notes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.NewSheet("July"); err != nil {
+		t.Fatal(err)
+	}
+	clock, err := book.NewStyle(&excelize.Style{NumFmt: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]any{
+		{"Employee ID", "Billable Rate (per hour)", "Project", "Date", "Start time", "End Time"},
+		{1, 100, "Acme", time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), 0.375, 0.5},
+		{2, "150", "Acme", "7/2/19", "09:00", "11:30"},
+		{3, 100, "Acme", time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 7, 1, 21, 0, 0, 0, time.UTC), "06:00"},
+		{4, "abc", "Acme", "7/2/19", "09:00", "10:00"},
+	}
+	for i, row := range rows {
+		if err := book.SetSheetRow("July", fmt.Sprintf("A%d", i+2), &row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := book.SetCellStyle("July", "E3", "F3", clock); err != nil {
+		t.Fatal(err)
+	}
+	content, err := book.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := readXLSX(bytes.NewReader(content.Bytes()), "july.xlsx", UploadOptions{Sheet: "2", Mode: ModeLenient})
+	if err != nil {
+		t.Fatalf("readXLSX returned error: %v", err)
+	}
+	for id, want := range map[int]float64{1: 3, 2: 2.5, 3: 9} {
+		if got := res.Companies["acme"][id].TotalHours; math.Abs(got-want) > 1e-9 {
+			t.Errorf("employee %d: expected %g hours, got %g", id, want, got)
+		}
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0].Line != 6 || res.Rejected[0].Column != colBillableRate {
+		t.Fatalf("expected row 6 to be rejected for its rate, got %+v", res.Rejected)
+	}
+
+	if _, err := readXLSX(bytes.NewReader(content.Bytes()), "july.xlsx", UploadOptions{Sheet: "August"}); err == nil || !strings.Contains(err.Error(), "Notes, July") {
+		t.Fatalf("expected an error listing the sheets, got %v", err)
+	}
+
+	// uploads named .xlsx are read as workbooks, through the same validation as CSV
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", "july.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteField("sheet", "july"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"Line":6`) {
+		t.Fatalf("expected 422 for row 6, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadCSV_Dialects(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	utf16le := func(text string) []byte {
+		b := []byte{0xFF, 0xFE}
+		for _, u := range utf16.Encode([]rune(text)) {
+			b = append(b, byte(u), byte(u>>8))
+		}
+		return b
+	}
+	utf16be := func(text string) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(text)) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		return b
+	}
+
+	book1, err := os.ReadFile(filepath.Join("testFiles", "Book1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		dialect CSVDialect
+		company string
+		entries int
+	}{
+		{"whole-line quoted", book1, CSVDialect{EncodingUTF8, ",", QuoteLine}, "netflix", 1},
+		{"semicolons with a BOM", []byte("\xEF\xBB\xBFEmployee ID;Billable Rate;Project;Date;Start time;End Time\r\n1;100;Acme, Inc;7/1/19;09:00;11:00\r\n"),
+			CSVDialect{EncodingUTF8, ";", QuoteStandard}, "acme, inc", 1},
+		{"tabs with an empty column", []byte("Employee ID\tRate\tCurrency\tProject\tDate\tStart\tEnd\n1\t100\t\tAcme\t7/1/19\t09:00\t11:00\n2\t100\tEUR\tAcme\t7/1/19\t09:00\t11:00\n"),
+			CSVDialect{EncodingUTF8, "\t", QuoteStandard}, "acme", 2},
+		{"UTF-16LE", utf16le("Employee ID,Rate,Project,Date,Start,End\n1,100,Zürich AG,7/1/19,09:00,11:00\n"),
+			CSVDialect{EncodingUTF16LE, ",", QuoteStandard}, "zürich ag", 1},
+		{"UTF-16BE without a BOM", utf16be("Employee ID|Rate|Project|Date|Start|End\n1|100|Acme|7/1/19|09:00|11:00\n"),
+			CSVDialect{EncodingUTF16BE, "|", QuoteStandard}, "acme", 1},
+		{"Latin-1", []byte("Employee ID;Rate;Project;Date;Start;End\n1;100;Caf\xE9 Noir;7/1/19;09:00;11:00\n"),
+			CSVDialect{EncodingLatin1, ";", QuoteStandard}, "café noir", 1},
+	}
+	for _, tt := range tests {
+		res, err := readCSV(bytes.NewReader(tt.content), "test.csv", UploadOptions{Mode: ModeValidate})
+		if err != nil {
+			t.Fatalf("%s: readCSV returned error: %v", tt.name, err)
+		}
+		if res.Dialect == nil || *res.Dialect != tt.dialect {
+			t.Errorf("%s: expected dialect %+v, got %+v", tt.name, tt.dialect, res.Dialect)
+		}
+		if n := len(res.Companies[tt.company]); n != tt.entries {
+			t.Errorf("%s: expected %d employees for %q, got %v", tt.name, tt.entries, tt.company, res.Companies)
+		}
+	}
+
+	// European exports separated by semicolons write rates with a decimal comma
+	res, err := readCSV(strings.NewReader("Employee ID;Rate;Project;Date;Start;End\n1;100,5;Acme;7/1/19;09:00;11:00\n2;1.000,25;Acme;7/1/19;09:00;10:00\n"),
+		"test.csv", UploadOptions{Mode: ModeValidate})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if e := res.Companies["acme"]; e[1].TotalCost != 201 || e[2].TotalCost != 1000.25 {
+		t.Errorf("expected decimal comma rates of 100.5 and 1000.25, got %+v", e)
+	}
+	xs, err := readExchangeRates(strings.NewReader("Base;Quote;Rate\r\nEUR;USD;1,08\r\n"))
+	if err != nil {
+		t.Fatalf("readExchangeRates returned error: %v", err)
+	}
+	if len(xs) != 1 || xs[0] != (ExchangeRate{Base: "EUR", Quote: "USD", Rate: 1.08}) {
+		t.Errorf("expected a semicolon separated EUR/USD rate of 1.08, got %+v", xs)
+	}
+
+	// an explicit delimiter wins over detection, so this file has a single column
+	_, err = readCSV(bytes.NewReader(tests[1].content), "test.csv", UploadOptions{Dialect: CSVDialect{Delimiter: ","}})
+	if err == nil || !strings.Contains(err.Error(), "missing required columns") {
+		t.Fatalf("expected missing columns with a comma delimiter, got %v", err)
+	}
+
+	// encoding=utf-16 takes the byte order from the byte order mark
+	utf16 := "Employee ID,Rate,Project,Date,Start,End\n1,100,Zürich AG,7/1/19,09:00,11:00\n"
+	for _, tt := range []struct {
+		content  []byte
+		encoding string
+	}{
+		{utf16le(utf16), EncodingUTF16LE},
+		{append([]byte{0xFE, 0xFF}, utf16be(utf16)...), EncodingUTF16BE},
+	} {
+		override, err := parseDialect("", "UTF-16", "")
+		if err != nil {
+			t.Fatalf("parseDialect returned error: %v", err)
+		}
+		res, err := readCSV(bytes.NewReader(tt.content), "test.csv", UploadOptions{Mode: ModeValidate, Dialect: override})
+		if err != nil {
+			t.Fatalf("%s: readCSV returned error: %v", tt.encoding, err)
+		}
+		if res.Dialect == nil || res.Dialect.Encoding != tt.encoding {
+			t.Errorf("expected utf-16 to be read as %s, got %+v", tt.encoding, res.Dialect)
+		}
+		if len(res.Companies["zürich ag"]) != 1 {
+			t.Errorf("%s: expected an employee for zürich ag, got %v", tt.encoding, res.Companies)
+		}
+	}
+
+	for _, fields := range []map[string]string{{"delimiter": "::"}, {"encoding": "ebcdic"}, {"quoting": "double"}} {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		fw, err := w.CreateFormFile("file", "test.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(tests[1].content)
+		for k, v := range fields {
+			w.WriteField(k, v)
+		}
+		w.Close()
+
+		req := httptest.NewRequest("POST", "/api/upload", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rr := httptest.NewRecorder()
+		Router().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", fields, rr.Code)
+		}
+	}
+}
+
+func TestReadCSV_Dates(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+	if _, err := saveClient(Client{Name: "Berlin GmbH", Locale: "de-DE"}); err != nil {
+		t.Fatalf("saveClient returned error: %v", err)
+	}
+
+	const header = "Employee ID,Rate,Project,Date,Start,End\n"
+	tests := []struct {
+		name      string
+		rows      string
+		locale    string
+		dates     []string
+		hours     float64
+		ambiguous int
+	}{
+		{"us locale", "1,100,Acme,2/1/19,09:00,11:00\n", LocaleUS, []string{"2019-02-01"}, 2, 0},
+		{"eu locale", "1,100,Acme,2.1.2019,09:00,11:00\n", LocaleEU, []string{"2019-01-02"}, 2, 0},
+		{"client locale", "1,100,Berlin GmbH,2/1/19,09:00,11:00\n", "", []string{"2019-01-02"}, 2, 0},
+		{"inferred from the file", "1,100,Acme,13/1/19,09:00,11:00\n1,100,Acme,2/1/19,09:00,11:00\n", "",
+			[]string{"2019-01-02", "2019-01-13"}, 4, 0},
+		{"ambiguous", "1,100,Acme,2/1/19,09:00,11:00\n1,100,Acme,3/3/19,09:00,11:00\n", "",
+			[]string{"2019-02-01", "2019-03-03"}, 4, 1},
+		{"12-hour times", "1,100,Acme,2019-07-01,9:00 AM,5:30pm\n", "", []string{"2019-07-01"}, 8.5, 0},
+	}
+	for _, tt := range tests {
+		res, err := readCSV(strings.NewReader(header+tt.rows), "test.csv", UploadOptions{Locale: tt.locale})
+		if err != nil {
+			t.Fatalf("%s: readCSV returned error: %v", tt.name, err)
+		}
+		if len(res.Ambiguous) != tt.ambiguous {
+			t.Errorf("%s: expected %d ambiguous dates, got %+v", tt.name, tt.ambiguous, res.Ambiguous)
+		}
+		entries, err := loadEntries(EntryFilter{BatchID: res.ID})
+		if err != nil {
+			t.Fatalf("%s: loadEntries returned error: %v", tt.name, err)
+		}
+		var dates []string
+		var hours float64
+		for _, e := range entries {
+			dates = append(dates, e.Date.Format(dateLayout))
+			hours += e.Hours
+		}
+		slices.Sort(dates)
+		if !slices.Equal(dates, tt.dates) || hours != tt.hours {
+			t.Errorf("%s: expected dates %v and %v hours, got %v and %v", tt.name, tt.dates, tt.hours, dates, hours)
+		}
+	}
+
+	// with a locale, a date that only reads the other way is rejected
+	res, err := readCSV(strings.NewReader(header+"1,100,Acme,1/13/19,09:00,11:00\n"), "test.csv", UploadOptions{Mode: ModeValidate, Locale: LocaleEU})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0].Column != colDate {
+		t.Errorf("expected the date rejected for locale eu, got %+v", res.Rejected)
+	}
+
+	if _, err := saveClient(Client{Name: "Elsewhere", Locale: "klingon"}); err == nil {
+		t.Error("expected an invalid client locale to be rejected")
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(header + "1,100,Acme,2/1/19,09:00,11:00\n"))
+	w.WriteField("locale", "mars")
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid locale, got %d", rr.Code)
+	}
+}
+
+func TestReadCSV_Merge(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	const header = "Employee ID,Rate,Project,Date,Start,End\n"
+	week1 := header + "1,100,Acme,2019-07-01,09:00,11:00\n2,100,Acme,2019-07-01,09:00,11:00\n"
+	month := header +
+		"1,100,Acme,2019-07-01,09:00,11:00\n" + // already uploaded
+		"2,100,ACME,2019-07-01,09:00,11:00\n" + // already uploaded, company in another case
+		"1,100,Acme,2019-07-01,13:00,14:00\n" + // new, a later shift that day
+		"1,100,Acme,2019-07-08,09:00,11:00\n" + // new
+		"1,100,Acme,2019-07-08,09:00,11:00\n" // repeats the line before
+
+	first, err := readCSV(strings.NewReader(week1), "week1.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+
+	res, err := readCSV(strings.NewReader(month), "month.csv", UploadOptions{Mode: ModeMerge})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if res.EntryCount != 2 {
+		t.Errorf("expected 2 new entries stored, got %d", res.EntryCount)
+	}
+	if e := res.Companies["acme"][1]; e.TotalHours != 3 {
+		t.Errorf("expected the summary to hold employee 1's 3 new hours, got %v", e.TotalHours)
+	}
+
+	var lines []int
+	for _, d := range res.Duplicates {
+		lines = append(lines, d.Line)
+	}
+	if !slices.Equal(lines, []int{2, 3, 6}) {
+		t.Fatalf("expected duplicates on lines 2, 3 and 6, got %+v", res.Duplicates)
+	}
+	if !strings.Contains(res.Duplicates[0].Reason, first.ID) || res.Duplicates[2].Reason != "duplicate of line 5" {
+		t.Errorf("expected duplicates to name the batch or line they repeat, got %+v", res.Duplicates)
+	}
+
+	// acme is billed for every distinct entry exactly once
+	entries, err := loadEntries(EntryFilter{Company: "acme"})
+	if err != nil {
+		t.Fatalf("loadEntries returned error: %v", err)
+	}
+	if e := rollup(entries)["acme"][1]; e.TotalHours != 5 {
+		t.Errorf("expected employee 1 total 5 hours, got %v", e.TotalHours)
+	}
+
+	// merging the same file again has nothing new, so it is rejected without creating a batch
+	_, err = readCSV(strings.NewReader(month), "month.csv", UploadOptions{Mode: ModeMerge})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 5 {
+		t.Errorf("expected a repeated merge to be rejected with 5 duplicates, got %v", err)
+	}
+	batches, err := listBatches()
+	if err != nil {
+		t.Fatalf("listBatches returned error: %v", err)
+	}
+	if len(batches) != 2 {
+		t.Errorf("expected 2 batches, got %d", len(batches))
+	}
+
+	// without a merge, uploads are appended as they are
+	res, err = readCSV(strings.NewReader(week1), "week1.csv", UploadOptions{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if res.EntryCount != 2 || res.Duplicates != nil {
+		t.Errorf("expected a plain upload to store both entries unchecked, got %d and %+v", res.EntryCount, res.Duplicates)
+	}
+}
+
+func TestUpload_MergeSample(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+	sample, err := os.ReadFile(filepath.Join("testFiles", "tableConvert.com_3yl8hs.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func() *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		fw, err := w.CreateFormFile("file", "sample.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(sample)
+		w.WriteField("mode", ModeMerge)
+		w.Close()
+
+		req := httptest.NewRequest("POST", "/api/upload", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rr := httptest.NewRecorder()
+		Router().ServeHTTP(rr, req)
+		return rr
+	}
+
+	// concurrent merges of the same file store its rows once
+	codes := make(chan int, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- upload().Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	var got []int
+	for code := range codes {
+		got = append(got, code)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []int{http.StatusOK, http.StatusUnprocessableEntity}) {
+		t.Fatalf("expected one merge to store the file and one to be rejected, got %v", got)
+	}
+
+	if rr := upload(); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "duplicate") {
+		t.Fatalf("expected a repeated merge to be rejected as duplicates, got %d: %s", rr.Code, rr.Body.String())
+	}
+	batches, err := listBatches()
+	if err != nil {
+		t.Fatalf("listBatches returned error: %v", err)
+	}
+	if len(batches) != 1 || batches[0].EntryCount != 4 {
+		t.Fatalf("expected a single batch of 4 entries, got %+v", batches)
+	}
+	entries, err := loadEntries(EntryFilter{})
+	if err != nil {
+		t.Fatalf("loadEntries returned error: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("expected 4 stored entries, got %d", len(entries))
+	}
+}
@@ -17,14 +17,21 @@ type SuccessResponse[T any] struct {
 type ErrorResponse struct {
 	Message string `json:"message"`
 	Error   string `json:"error"`
+	Details any    `json:"details,omitempty"`
 	Success bool   `json:"success"`
 }
 
 // RespondWithError returns consistent error messages
 func RespondWithError(w http.ResponseWriter, statusCode int, message string, err string) {
+	RespondWithErrorDetails(w, statusCode, message, err, nil)
+}
+
+// RespondWithErrorDetails returns an error message with structured details, e.g. a validation report
+func RespondWithErrorDetails(w http.ResponseWriter, statusCode int, message string, err string, details any) {
 	resp := ErrorResponse{
 		Message: message,
 		Error:   err,
+		Details: details,
 		Success: false,
 	}
 
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// excel uploads:
+// - .xlsx and .xlsm workbooks are read from a single sheet, picked by name or 1-based index
+//   (the first sheet by default)
+// - the sheet's first non-empty row is the header, matched like a CSV header (see resolveColumns)
+// - cells are read without their number formats, so IDs and rates arrive as plain numbers
+// - native date and time cells are Excel serial numbers; in the date, start and end columns they
+//   are turned into the text the CSV parser reads, so both formats share the same validation
+// - line numbers in problems are the sheet's row numbers
+
+// spreadsheetExtensions are the file extensions uploaded as Excel workbooks
+var spreadsheetExtensions = []string{".xlsx", ".xlsm"}
+
+// isSpreadsheet reports whether an uploaded file is an Excel workbook, going by its name
+func isSpreadsheet(filename string) bool {
+	return slices.Contains(spreadsheetExtensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// readXLSX reads and processes a sheet of the Excel workbook provided, storing it as a new
+// batch (see importRows)
+func readXLSX(reader io.Reader, filename string, opts UploadOptions) (UploadResult, error) {
+	book, err := excelize.OpenReader(reader)
+	if err != nil {
+		return UploadResult{}, fmt.Errorf("failed to open workbook: %w", err)
+	}
+	defer book.Close()
+
+	sheet, err := pickSheet(book.GetSheetList(), opts.Sheet)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	rows, err := book.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return UploadResult{}, fmt.Errorf("failed to read sheet %s: %w", sheet, err)
+	}
+	props, err := book.GetWorkbookProps()
+	if err != nil {
+		return UploadResult{}, fmt.Errorf("failed to read workbook: %w", err)
+	}
+	date1904 := props.Date1904 != nil && *props.Date1904
+
+	// the header is the first row with anything in it
+	i := slices.IndexFunc(rows, func(row []string) bool { return !blankRow(row) })
+	if i < 0 {
+		return UploadResult{}, fmt.Errorf("sheet %s is empty", sheet)
+	}
+	header := rows[i]
+	columns, err := resolveColumns(header, opts.Mapping)
+	if err != nil {
+		return UploadResult{}, err
+	}
+
+	return importRows(header, func() ([]string, int, error) {
+		for i++; i < len(rows); i++ {
+			if !blankRow(rows[i]) {
+				return excelRecord(rows[i], columns, date1904), i + 1, nil
+			}
+		}
+		return nil, 0, io.EOF
+	}, filename, opts)
+}
+
+// pickSheet finds a sheet by name, case-insensitively, or by 1-based index; empty means the first sheet
+func pickSheet(sheets []string, ref string) (string, error) {
+	if len(sheets) == 0 {
+		return "", fmt.Errorf("workbook has no sheets")
+	}
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return sheets[0], nil
+	}
+	for _, name := range sheets {
+		if strings.EqualFold(name, ref) {
+			return name, nil
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 1 && n <= len(sheets) {
+		return sheets[n-1], nil
+	}
+	return "", fmt.Errorf("sheet %q not found, the workbook has: %s", ref, strings.Join(sheets, ", "))
+}
+
+// blankRow reports whether every cell of a row is empty
+func blankRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// excelRecord turns a sheet row into a timesheet record, writing the serial numbers of native
+// date and time cells as a date ("2006-01-02"), clock time ("15:04") or datetime ("2006-01-02 15:04")
+func excelRecord(row []string, columns map[string]int, date1904 bool) []string {
+	record := slices.Clone(row)
+	for _, col := range []string{colDate, colStartTime, colEndTime} {
+		i := columns[col]
+		if i >= len(record) {
+			continue
+		}
+		serial, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+		if err != nil {
+			continue
+		}
+		t, err := excelize.ExcelDateToTime(serial, date1904)
+		if err != nil {
+			continue
+		}
+		t = t.Round(time.Minute)
+
+		switch {
+		case col == colDate:
+			record[i] = t.Format(dateLayout)
+		case serial < 1:
+			// a time of day without a date
+			record[i] = t.Format(clockLayout)
+		default:
+			record[i] = t.Format(dateTimeLayout)
+		}
+	}
+	return record
+}
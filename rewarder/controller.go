@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 )
@@ -25,14 +26,31 @@ func upload(w http.ResponseWriter, r *http.Request) {
 
 	//fmt.Printf("uploaded File: %+v\n", header)
 
-	// process csv from upload
-	v, err := readCSV(file)
+	// "delimiter", "encoding" and "quoting" override the detected dialect of the file
+	dialect, err := parseDialect(r.FormValue("delimiter"), r.FormValue("encoding"), r.FormValue("quoting"))
 	if err != nil {
+		RespondWithError(w, 400, "invalid upload options", err.Error())
+		return
+	}
+
+	// process csv from upload, "mode" is strict, lenient or validate
+	mode := r.FormValue("mode")
+	res, err := readCSV(file, mode, dialect)
+	if err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			RespondWithErrorDetails(w, 422, "file failed validation", err.Error(), verr.Errors)
+			return
+		}
 		RespondWithError(w, 400, "failed to read file", err.Error())
 		return
 	}
 
-	err = RespondWithJSON(w, 200, "file uploaded successfully", v)
+	message := "file uploaded successfully"
+	if mode == ModeValidate {
+		message = "file validated successfully"
+	}
+	err = RespondWithJSON(w, 200, message, res)
 	if err != nil {
 		log.Printf("failed to write response: %v", err)
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -21,8 +22,10 @@ import (
 //	- expiry date (creation date + validity)
 //
 // insertion:
-// - loop through csv file
-// - create voucher entry:
+// - read the csv file in its detected or given dialect (encoding, delimiter, quoting, see dialect.go)
+// - loop through csv file, collecting every invalid line (line, column, reason)
+// - strict: reject the upload if any line is invalid; lenient: skip invalid lines; validate: create nothing
+// - create voucher entry for each valid line:
 //	- if order value >= 1000 and order value < 5000:
 //		- createVoucher(amount:100, validity:1)
 //	- else if order value >= 5000 and order value < 10000:
@@ -81,60 +84,146 @@ func createVoucher(amount float64, validity int, customerID int, customerName st
 	return v
 }
 
-// readCSV reads and processes the CSV file provided
-func readCSV(reader io.Reader) ([]Voucher, error) {
-	csvReader := csv.NewReader(reader)
-	csvReader.FieldsPerRecord = -1
-	csvReader.TrimLeadingSpace = true
+// upload modes
+const (
+	// ModeStrict rejects the whole upload when any row is invalid
+	ModeStrict = "strict"
+	// ModeLenient creates vouchers for the valid rows and reports the rejected ones
+	ModeLenient = "lenient"
+	// ModeValidate only reports problems, no vouchers are created
+	ModeValidate = "validate"
+)
+
+// RowError describes a single problem found in an uploaded file
+type RowError struct {
+	Line   int
+	Column string
+	Value  string
+	Reason string
+}
+
+// ValidationError is returned when an upload is rejected, carrying every problem found
+type ValidationError struct {
+	Errors []RowError
+}
+
+func (e *ValidationError) Error() string {
+	first := e.Errors[0]
+	msg := fmt.Sprintf("line %d: %s", first.Line, first.Reason)
+	if first.Column != "" {
+		msg = fmt.Sprintf("line %d: %s %q: %s", first.Line, first.Column, first.Value, first.Reason)
+	}
+	if len(e.Errors) > 1 {
+		msg += fmt.Sprintf(" (and %d more problems)", len(e.Errors)-1)
+	}
+	return msg
+}
+
+// UploadResult is returned after an upload: the vouchers created, the rows rejected
+// and the dialect the file was read in
+type UploadResult struct {
+	Vouchers []Voucher
+	Rejected []RowError
+	Dialect  *CSVDialect
+}
+
+// order is a validated line of an uploaded orders file
+type order struct {
+	customerID   int
+	customerName string
+	value        float64
+}
+
+// readCSV reads and processes the CSV file provided, in its detected dialect except where the
+// override sets one. Every row is checked before any voucher is created; how invalid rows are
+// handled depends on the mode.
+func readCSV(reader io.Reader, mode string, override CSVDialect) (UploadResult, error) {
+	if mode == "" {
+		mode = ModeStrict
+	}
+	if mode != ModeStrict && mode != ModeLenient && mode != ModeValidate {
+		return UploadResult{}, fmt.Errorf("unknown upload mode %q, expected strict, lenient or validate", mode)
+	}
+
+	src, err := openCSV(reader, override)
+	if err != nil {
+		return UploadResult{}, err
+	}
 
 	// skip header
-	if _, err := csvReader.Read(); err != nil {
-		return nil, fmt.Errorf("failed to read header: %w", err)
+	if _, _, err := src.Read(); err != nil {
+		return UploadResult{}, fmt.Errorf("failed to read header: %w", err)
 	}
 
-	var vouchers []Voucher
+	var orders []order
+	rejected := []RowError{}
 
 	// read lines
 	for {
-		record, err := csvReader.Read()
+		record, line, err := src.Read()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+
+			// malformed lines are reported like any other invalid row
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rejected = append(rejected, RowError{Line: parseErr.Line, Reason: parseErr.Err.Error()})
+				continue
+			}
+			return UploadResult{}, err
 		}
 
 		if len(record) < 3 {
-			return nil, fmt.Errorf("invalid record: expected >=3 fields, got %d", len(record))
+			rejected = append(rejected, RowError{Line: line, Reason: fmt.Sprintf("invalid record: expected >=3 fields, got %d", len(record))})
+			continue
 		}
 
-		id, fName, orderValue := record[0], record[1], record[2]
+		id, fName, orderValue := strings.TrimSpace(record[0]), record[1], strings.TrimSpace(record[2])
+		var problems []RowError
 
 		// format data from file
-		// todo: maybe check the order value is greater than 999 (so we'll create a voucher) before formatting all the values?
-		cid, err := strconv.Atoi(strings.TrimSpace(id))
+		cid, err := strconv.Atoi(id)
 		if err != nil {
-			return nil, fmt.Errorf("invalid customer ID: %s", id)
+			problems = append(problems, RowError{Line: line, Column: "customer_id", Value: id, Reason: "invalid customer ID"})
 		}
 
 		fName = strings.TrimSpace(strings.ToLower(fName))
 
-		value, err := strconv.ParseFloat(strings.TrimSpace(orderValue), 64)
+		value, err := src.dialect.parseNumber(orderValue)
 		if err != nil {
-			return nil, fmt.Errorf("invalid order value: %s", orderValue)
+			problems = append(problems, RowError{Line: line, Column: "order_value", Value: orderValue, Reason: "invalid order value"})
 		}
 
-		// create vouchers
-		if value < 1000 {
+		if len(problems) > 0 {
+			rejected = append(rejected, problems...)
+			continue
+		}
+		orders = append(orders, order{customerID: cid, customerName: fName, value: value})
+	}
+
+	if len(rejected) > 0 && (mode == ModeStrict || len(orders) == 0 && mode == ModeLenient) {
+		return UploadResult{}, &ValidationError{Errors: rejected}
+	}
+
+	res := UploadResult{Vouchers: []Voucher{}, Rejected: rejected, Dialect: &src.dialect}
+	if mode == ModeValidate {
+		return res, nil
+	}
+
+	// create vouchers
+	for _, o := range orders {
+		if o.value < 1000 {
 			continue
-		} else if value >= 1000 && value < 5000 {
-			vouchers = append(vouchers, createVoucher(100, 1, cid, fName, value))
-		} else if value >= 5000 && value < 10000 {
-			vouchers = append(vouchers, createVoucher(500, 5, cid, fName, value))
-		} else if value >= 10000 {
-			vouchers = append(vouchers, createVoucher(1000, 10, cid, fName, value))
+		} else if o.value >= 1000 && o.value < 5000 {
+			res.Vouchers = append(res.Vouchers, createVoucher(100, 1, o.customerID, o.customerName, o.value))
+		} else if o.value >= 5000 && o.value < 10000 {
+			res.Vouchers = append(res.Vouchers, createVoucher(500, 5, o.customerID, o.customerName, o.value))
+		} else if o.value >= 10000 {
+			res.Vouchers = append(res.Vouchers, createVoucher(1000, 10, o.customerID, o.customerName, o.value))
 		}
 	}
 
-	return vouchers, nil
+	return res, nil
 }
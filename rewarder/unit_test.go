@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -24,10 +25,11 @@ func TestReadCSV(t *testing.T) {
 6,Akua,999
 7,Mensah,10000
 `
-	vouchers, err := readCSV(strings.NewReader(csv))
+	res, err := readCSV(strings.NewReader(csv), ModeStrict, CSVDialect{})
 	if err != nil {
 		t.Fatalf("readCSV returned error: %v", err)
 	}
+	vouchers := res.Vouchers
 
 	// assertions?
 	// should get 5 vouchers (all except kweku=100 and akua=999)
@@ -97,3 +99,128 @@ func TestUploadCSV(t *testing.T) {
 		t.Fatalf("expected 200 OK, got %d, body: %s", rr.Code, rr.Body.String())
 	}
 }
+
+func TestReadCSV_ValidationModes(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	csv := `Customer ID,Customer First Name,Order Value
+1,Kweku,1200
+x,Abena,abc
+3,Kojo,4800
+4,Esi,lots
+`
+	// strict: every problem is reported and no vouchers are created
+	_, err := readCSV(strings.NewReader(csv), ModeStrict, CSVDialect{})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if len(verr.Errors) != 3 {
+		t.Fatalf("expected 3 problems, got %+v", verr.Errors)
+	}
+	if verr.Errors[2].Line != 5 || verr.Errors[2].Column != "order_value" {
+		t.Fatalf("expected line 5 order_value problem, got %+v", verr.Errors[2])
+	}
+
+	// validate: problems reported, no vouchers
+	res, err := readCSV(strings.NewReader(csv), ModeValidate, CSVDialect{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if len(res.Vouchers) != 0 || len(res.Rejected) != 3 {
+		t.Fatalf("expected no vouchers and 3 rejected rows, got %d and %d", len(res.Vouchers), len(res.Rejected))
+	}
+
+	// lenient: vouchers for the valid rows
+	res, err = readCSV(strings.NewReader(csv), ModeLenient, CSVDialect{})
+	if err != nil {
+		t.Fatalf("readCSV returned error: %v", err)
+	}
+	if len(res.Vouchers) != 2 || len(res.Rejected) != 3 {
+		t.Fatalf("expected 2 vouchers and 3 rejected rows, got %d and %d", len(res.Vouchers), len(res.Rejected))
+	}
+}
+
+func TestReadCSV_Dialects(t *testing.T) {
+	if err := InitDB(":memory:"); err != nil {
+		t.Fatalf("failed to init db: %v", err)
+	}
+
+	utf16le := func(text string) []byte {
+		b := []byte{0xFF, 0xFE}
+		for _, r := range text {
+			b = append(b, byte(r), byte(r>>8))
+		}
+		return b
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		dialect CSVDialect
+		value   float64
+	}{
+		{"semicolons in Latin-1 with a decimal comma", []byte("Customer ID;Customer First Name;Order Value\n1;J\xFCrgen;1.500,50\n"),
+			CSVDialect{EncodingLatin1, ";", QuoteStandard}, 1500.5},
+		{"UTF-16LE tabs", utf16le("Customer ID\tCustomer First Name\tOrder Value\r\n1\tAbena\t1200\r\n"),
+			CSVDialect{EncodingUTF16LE, "\t", QuoteStandard}, 1200},
+		{"whole-line quoted", []byte("\"Customer ID,Customer First Name,Order Value\"\n\"1,Kojo,4800\"\n"),
+			CSVDialect{EncodingUTF8, ",", QuoteLine}, 4800},
+	}
+	for _, tt := range tests {
+		res, err := readCSV(bytes.NewReader(tt.content), ModeStrict, CSVDialect{})
+		if err != nil {
+			t.Fatalf("%s: readCSV returned error: %v", tt.name, err)
+		}
+		if res.Dialect == nil || *res.Dialect != tt.dialect {
+			t.Errorf("%s: expected dialect %+v, got %+v", tt.name, tt.dialect, res.Dialect)
+		}
+		if len(res.Vouchers) != 1 || res.Vouchers[0].OrderValue != tt.value {
+			t.Errorf("%s: expected a voucher for an order of %v, got %+v", tt.name, tt.value, res.Vouchers)
+		}
+	}
+
+	// encoding=utf-16 takes the byte order from the byte order mark
+	utf16be := []byte{0xFE, 0xFF}
+	for _, r := range "Customer ID,Customer First Name,Order Value\n1,Abena,1200\n" {
+		utf16be = append(utf16be, byte(r>>8), byte(r))
+	}
+	for _, tt := range []struct {
+		content  []byte
+		encoding string
+	}{
+		{tests[1].content, EncodingUTF16LE},
+		{utf16be, EncodingUTF16BE},
+	} {
+		override, err := parseDialect("", "utf16", "")
+		if err != nil {
+			t.Fatalf("parseDialect returned error: %v", err)
+		}
+		res, err := readCSV(bytes.NewReader(tt.content), ModeStrict, override)
+		if err != nil {
+			t.Fatalf("%s: readCSV returned error: %v", tt.encoding, err)
+		}
+		if res.Dialect == nil || res.Dialect.Encoding != tt.encoding || len(res.Vouchers) != 1 {
+			t.Errorf("expected utf-16 to be read as %s, got %+v with %+v", tt.encoding, res.Dialect, res.Vouchers)
+		}
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fw, err := w.CreateFormFile("file", "orders.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(tests[0].content)
+	w.WriteField("delimiter", "::")
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &b)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rr := httptest.NewRecorder()
+	Router().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid delimiter, got %d", rr.Code)
+	}
+}